@@ -0,0 +1,3502 @@
+package generator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
+)
+
+const clientTemplate = `
+{{- define "params"}}{{if .Params}}{{range $i, $p := .Params}}{{if $i}}, {{end}}{{$p.Name}} {{if $p.Variadic}}...{{slice $p.Type 2}}{{else}}{{$p.Type}}{{end}}{{end}}{{else if .HasRequest}}{{.RequestName}} {{if .Variadic}}...{{slice .RequestType 2}}{{else}}{{.RequestType}}{{end}}{{end}}{{end -}}
+{{- define "request"}}{{if .Params}}{{.RequestType}}{ {{- range $i, $p := .Params}}{{if $i}}, {{end}}{{$p.Field}}: {{$p.Name}}{{end -}} }{{else if .HasRequest}}{{.RequestName}}{{else}}struct{}{}{{end}}{{end -}}
+{{- define "signature"}}{{.Name}}({{if .ContextType}}_ {{.ContextType}}{{else}}{{.ContextName}} context.Context{{end}}{{if .HasRequest}}, {{template "params" .}}{{end}}) ({{if .HasResponse}}{{if .ResponsePointer}}*{{end}}{{.ResponseType}}, {{end}}error){{end -}}
+{{- define "zero"}}{{if .ResponsePointer}}nil{{else}}*new({{.ResponseType}}){{end}}{{end -}}
+
+// Code generated by rpc-gen; DO NOT EDIT.
+// Source: {{.SourceFile}} ({{.ServiceName}})
+
+package {{.PackageName}}
+
+import (
+{{range .StdImports}}   "{{.Path}}"
+{{end}}
+{{range .Imports}}   {{.Name}} "{{.Path}}"
+{{end}})
+
+{{if .Assert}}
+var _ {{.ServiceType}} = (*{{.ServiceName}}Client)(nil)
+{{end}}
+
+{{if .ClientIface}}
+var _ {{.ServiceName}}{{.ClientIfaceSuffix}} = (*{{.ServiceName}}Client)(nil)
+
+type {{.ServiceName}}{{.ClientIfaceSuffix}} interface {
+{{- range .Methods}}
+   {{template "signature" .}}
+{{- end}}
+   {{.CloseName}}() error
+}
+{{end}}
+
+{{if and (eq .Codec "gob") (not .NoRegister) .GobTypes}}
+func init() {
+{{- range .GobTypes}}
+   gob.Register({{.}}{})
+{{- end}}
+}
+{{end}}
+
+{{if .Methods}}
+// Names of the {{.RPCName}} methods, as passed to rpc.Client.Call.
+const (
+{{- range .Methods}}
+   Method{{$.ServiceName}}{{.Name}} = "{{$.RPCName}}.{{.Name}}"
+{{- end}}
+)
+{{end}}
+
+// {{.ServiceName}}Interceptor runs around every call made by {{.ServiceName}}Client, such as
+// to record metrics or traces. method is the RPC name, req the request sent, and
+// invoke performs the call.
+type {{.ServiceName}}Interceptor func(ctx context.Context, method string, req any, invoke func() error) error
+
+// {{.ServiceName}}ClientOption configures a {{.ServiceName}}Client.
+type {{.ServiceName}}ClientOption func(*{{.ServiceName}}Client)
+
+// With{{.ServiceName}}Interceptor adds interceptor to the client. Interceptors run in
+// the order they are added, the first one outermost.
+func With{{.ServiceName}}Interceptor(interceptor {{.ServiceName}}Interceptor) {{.ServiceName}}ClientOption {
+   return func(c *{{.ServiceName}}Client) {
+       c.interceptors = append(c.interceptors, interceptor)
+   }
+}
+
+{{if .ServiceDoc -}}
+// {{.ServiceName}}Client calls the {{.RPCName}} service.
+//
+{{range .ServiceDoc}}{{.}}
+{{end -}}
+{{end -}}
+type {{.ServiceName}}Client struct {
+   client       *rpc.Client
+   interceptors []{{.ServiceName}}Interceptor
+{{- if ne .Network "http"}}
+
+   // network, codec, dialTimeout and tlsConfig configure dialing, set by
+   // With{{.ServiceName}}Network, With{{.ServiceName}}Codec, With{{.ServiceName}}Timeout and
+   // With{{.ServiceName}}TLSConfig.
+   network     string
+   codec       string
+   dialTimeout time.Duration
+   tlsConfig   *tls.Config
+{{- end}}
+{{- if and .Stringer (not .Swappable)}}
+
+   // address is the remote address String reports.
+   address string
+{{- end}}
+{{- if .Swappable}}
+
+   // dial connects to address again{{if .Reconnect}} when the connection fails{{end}}{{if .Redial}}{{if .Reconnect}} or{{end}} on Redial{{end}}.
+   // mu guards client, address and closed.
+   address string
+   dial    func(address string) (*rpc.Client, error)
+   mu      sync.Mutex
+   closed  bool
+{{- end}}
+}
+
+// New{{.ServiceName}}ClientWith returns a client making its calls on client, which
+// it closes on {{.CloseName}}.
+{{- if .Swappable}} The client cannot be redialed.{{end}}
+func New{{.ServiceName}}ClientWith(client *rpc.Client, opts ...{{.ServiceName}}ClientOption) *{{.ServiceName}}Client {
+   c := &{{.ServiceName}}Client{client: client}
+   for _, opt := range opts {
+       opt(c)
+   }
+
+   return c
+}
+
+// New{{.ServiceName}}ClientFromConn returns a client speaking the {{.Codec}} codec over conn,
+// such as a connection set up through a proxy or after a handshake.
+{{- if .Swappable}} The client cannot be redialed.{{end}}
+func New{{.ServiceName}}ClientFromConn(conn net.Conn, opts ...{{.ServiceName}}ClientOption) *{{.ServiceName}}Client {
+{{- if .Stringer}}
+   c := New{{.ServiceName}}ClientWith({{if eq .Codec "json"}}jsonrpc.NewClient(conn){{else}}rpc.NewClient(conn){{end}}, opts...)
+   c.address = conn.RemoteAddr().String()
+
+   return c
+{{- else}}
+   return New{{.ServiceName}}ClientWith({{if eq .Codec "json"}}jsonrpc.NewClient(conn){{else}}rpc.NewClient(conn){{end}}, opts...)
+{{- end}}
+}
+
+{{if eq .Network "http"}}
+func New{{.ServiceName}}Client(address string, opts ...{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+{{- if .Swappable}}
+   return new{{.ServiceName}}Client(address, func(address string) (*rpc.Client, error) {
+{{- end}}
+{{- if .HTTPPath}}
+   client, err := rpc.DialHTTPPath("tcp", address, {{printf "%q" .HTTPPath}})
+{{- else}}
+   client, err := rpc.DialHTTP("tcp", address)
+{{- end}}
+   if err != nil {
+       return nil, fmt.Errorf("{{$.PackageName}}.New{{.ServiceName}}Client rpc.DialHTTP error: %w", err)
+   }
+{{if .Swappable}}
+   return client, nil
+   }, opts...)
+{{- else if .Stringer}}
+   c := New{{.ServiceName}}ClientWith(client, opts...)
+   c.address = address
+
+   return c, nil
+{{- else}}
+   return New{{.ServiceName}}ClientWith(client, opts...), nil
+{{- end}}
+}
+{{else}}
+// New{{.ServiceName}}Client connects to address, over TLS when given With{{.ServiceName}}TLSConfig.
+func New{{.ServiceName}}Client(address string, opts ...{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+   return dial{{.ServiceName}}Client(context.Background(), address, opts)
+}
+
+// New{{.ServiceName}}ClientTimeout is like New{{.ServiceName}}Client with With{{.ServiceName}}Timeout(timeout).
+func New{{.ServiceName}}ClientTimeout(address string, timeout time.Duration, opts ...{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+   return dial{{.ServiceName}}Client(context.Background(), address, append(opts[:len(opts):len(opts)], With{{.ServiceName}}Timeout(timeout)))
+}
+
+// With{{.ServiceName}}Timeout bounds the time dialing may take, {{if .DialTimeout}}{{.DialTimeout}}{{else}}unlimited{{end}} by default.
+func With{{.ServiceName}}Timeout(timeout time.Duration) {{.ServiceName}}ClientOption {
+   return func(c *{{.ServiceName}}Client) {
+       c.dialTimeout = timeout
+   }
+}
+
+// With{{.ServiceName}}Network sets the network dialed, "tcp" or "unix", {{printf "%q" .Network}} by default.
+func With{{.ServiceName}}Network(network string) {{.ServiceName}}ClientOption {
+   return func(c *{{.ServiceName}}Client) {
+       c.network = network
+   }
+}
+
+// With{{.ServiceName}}Codec sets the codec spoken over the connection, "gob" or "json",
+// {{printf "%q" .Codec}} by default. It must match the server's.
+func With{{.ServiceName}}Codec(codec string) {{.ServiceName}}ClientOption {
+   return func(c *{{.ServiceName}}Client) {
+       c.codec = codec
+   }
+}
+
+// With{{.ServiceName}}TLSConfig makes the client dial with crypto/tls using config.
+func With{{.ServiceName}}TLSConfig(config *tls.Config) {{.ServiceName}}ClientOption {
+   return func(c *{{.ServiceName}}Client) {
+       c.tlsConfig = config
+   }
+}
+
+// dial{{.ServiceName}}Client applies opts to a new client and connects it to address.
+func dial{{.ServiceName}}Client(ctx context.Context, address string, opts []{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+   c := &{{.ServiceName}}Client{network: "{{.Network}}", codec: "{{.Codec}}", dialTimeout: {{duration .DialTimeout}}}
+   for _, opt := range opts {
+       opt(c)
+   }
+
+   if c.network != "tcp" && c.network != "unix" {
+       return nil, fmt.Errorf("{{$.PackageName}}.New{{.ServiceName}}Client invalid network %q: use tcp or unix", c.network)
+   }
+
+   if c.codec != "gob" && c.codec != "json" {
+       return nil, fmt.Errorf("{{$.PackageName}}.New{{.ServiceName}}Client invalid codec %q: use gob or json", c.codec)
+   }
+
+   client, err := c.dialContext(ctx, address)
+   if err != nil {
+       return nil, err
+   }
+
+   c.client = client
+{{- if or .Stringer .Swappable}}
+   c.address = address
+{{- end}}
+{{- if .Swappable}}
+   c.dial = func(address string) (*rpc.Client, error) {
+       return c.dialContext(context.Background(), address)
+   }
+{{- end}}
+
+   return c, nil
+}
+
+// dialContext connects to address with the client's network, codec, dial timeout and
+// TLS configuration.
+func (c *{{.ServiceName}}Client) dialContext(ctx context.Context, address string) (*rpc.Client, error) {
+   dialer := &net.Dialer{Timeout: c.dialTimeout}
+
+   var (
+       conn net.Conn
+       err  error
+   )
+   if c.tlsConfig != nil {
+       conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.tlsConfig}).DialContext(ctx, c.network, address)
+       if err != nil {
+           return nil, fmt.Errorf("{{$.PackageName}}.New{{.ServiceName}}Client tls.Dialer.DialContext error: %w", err)
+       }
+   } else {
+       conn, err = dialer.DialContext(ctx, c.network, address)
+       if err != nil {
+           return nil, fmt.Errorf("{{$.PackageName}}.New{{.ServiceName}}Client net.Dialer.DialContext error: %w", err)
+       }
+   }
+
+   if c.codec == "json" {
+       return jsonrpc.NewClient(conn), nil
+   }
+
+   return rpc.NewClient(conn), nil
+}
+{{end}}
+
+{{if .ContextDial}}
+// New{{.ServiceName}}ClientContext is like New{{.ServiceName}}Client but gives up dialing when
+// ctx is done.{{if .Swappable}} Later redials do not use ctx.{{end}}
+func New{{.ServiceName}}ClientContext(ctx context.Context, address string, opts ...{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+   return dial{{.ServiceName}}Client(ctx, address, opts)
+}
+{{end}}
+
+{{if .TLS}}
+// New{{.ServiceName}}ClientTLS is like New{{.ServiceName}}Client with With{{.ServiceName}}TLSConfig(config).
+func New{{.ServiceName}}ClientTLS(address string, config *tls.Config, opts ...{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+   return dial{{.ServiceName}}Client(context.Background(), address, append(opts[:len(opts):len(opts)], With{{.ServiceName}}TLSConfig(config)))
+}
+{{end}}
+
+{{if and .Swappable (eq .Network "http")}}
+// new{{.ServiceName}}Client connects to address with dial and keeps both to connect again later.
+func new{{.ServiceName}}Client(address string, dial func(address string) (*rpc.Client, error), opts ...{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+   client, err := dial(address)
+   if err != nil {
+       return nil, err
+   }
+
+   c := New{{.ServiceName}}ClientWith(client, opts...)
+   c.address, c.dial = address, dial
+
+   return c, nil
+}
+{{end}}
+
+{{if .Swappable}}
+func (c *{{.ServiceName}}Client) rpcClient() *rpc.Client {
+   c.mu.Lock()
+   defer c.mu.Unlock()
+
+   return c.client
+}
+{{end}}
+
+{{if .Redial}}
+// Redial connects to address and replaces the client's connection, closing the
+// previous one; calls still pending on it fail with rpc.ErrShutdown.
+func (c *{{.ServiceName}}Client) Redial(address string) error {
+   c.mu.Lock()
+   defer c.mu.Unlock()
+
+   if c.closed || c.dial == nil {
+       return rpc.ErrShutdown
+   }
+
+   client, err := c.dial(address)
+   if err != nil {
+       return fmt.Errorf("{{$.PackageName}}.{{.ServiceName}}Client.Redial error: %w", err)
+   }
+
+   _ = c.client.Close()
+   c.client, c.address = client, address
+
+   return nil
+}
+{{end}}
+
+{{if .Reconnect}}
+// redial replaces failed, the client a call failed on, with a new connection.
+// Calls failing on the same client concurrently share one redial.
+func (c *{{.ServiceName}}Client) redial(failed *rpc.Client) error {
+   c.mu.Lock()
+   defer c.mu.Unlock()
+
+   if c.closed || c.dial == nil {
+       return rpc.ErrShutdown
+   }
+
+   if c.client != failed {
+       return nil
+   }
+
+   client, err := c.dial(c.address)
+   if err != nil {
+       return err
+   }
+
+   _ = failed.Close()
+   c.client = client
+
+   return nil
+}
+{{end}}
+
+{{if .Retries}}
+// retryable{{.ServiceName}} reports whether err means the connection failed, as opposed
+// to the server returning an error, so that the call may be retried.
+func retryable{{.ServiceName}}(err error) bool {
+   var serverError rpc.ServerError
+   if errors.As(err, &serverError) {
+       return false
+   }
+
+   return errors.Is(err, rpc.ErrShutdown) ||
+       errors.Is(err, io.EOF) ||
+       errors.Is(err, io.ErrUnexpectedEOF) ||
+       errors.Is(err, syscall.ECONNRESET)
+}
+
+// backoff{{.ServiceName}} returns the delay before retry attempt+1, doubling from 100ms up to 5s.
+func backoff{{.ServiceName}}(attempt int) time.Duration {
+   if attempt >= 6 {
+       return 5 * time.Second
+   }
+
+   return 100 * time.Millisecond << attempt
+}
+{{end}}
+
+{{if .DeclareRPCError}}
+// RPCError is returned by the clients of the package when a call fails, either in
+// transport or with an error returned by the server, as opposed to being cancelled
+// through its context.
+type RPCError struct {
+   // Method is the RPC name of the failed call, such as a Method{{.ServiceName}} constant.
+   Method string
+   Err    error
+}
+
+func (e *RPCError) Error() string {
+   return "{{$.PackageName}}: " + e.Method + " call error: " + e.Err.Error()
+}
+
+func (e *RPCError) Unwrap() error {
+   return e.Err
+}
+{{end}}
+
+// intercept runs invoke through the client's interceptors.
+func (c *{{.ServiceName}}Client) intercept(ctx context.Context, method string, req any, invoke func() error) error {
+   for i := len(c.interceptors) - 1; i >= 0; i-- {
+       interceptor, next := c.interceptors[i], invoke
+       invoke = func() error {
+           return interceptor(ctx, method, req, next)
+       }
+   }
+
+   return invoke()
+}
+
+{{range .Methods}}
+{{range .Doc}}{{.}}
+{{end -}}
+func (c *{{$.ServiceName}}Client) {{template "signature" .}} {
+{{- if .ContextType}}
+   {{.ContextName}} := context.Background()
+{{end}}
+{{- if .Timeout}}
+   if _, ok := {{.ContextName}}.Deadline(); !ok {
+       var cancel context.CancelFunc
+       {{.ContextName}}, cancel = context.WithTimeout({{.ContextName}}, {{duration .Timeout}})
+       defer cancel()
+   }
+{{end}}
+   response := new({{.ResponseType}})
+{{- if $.Metadata}}
+   args := {{$.ServiceName}}Envelope[{{.RequestType}}]{Meta: {{$.ServiceName}}MetadataFrom({{.ContextName}}), Payload: {{template "request" .}}}
+{{- else}}
+   args := {{template "request" .}}
+{{- end}}
+
+   err := c.intercept({{.ContextName}}, Method{{$.ServiceName}}{{.Name}}, args, func() error {
+{{- if $.Retries}}
+       var call *rpc.Call
+       for attempt := 0; ; attempt++ {
+           client := c.rpcClient()
+           call = client.Go(Method{{$.ServiceName}}{{.Name}}, args, response, make(chan *rpc.Call, 1))
+           select {
+           case <-{{.ContextName}}.Done():
+               // The call completes in the background; its buffered Done channel never blocks.
+               return {{.ContextName}}.Err()
+           case call = <-call.Done:
+           }
+
+           if call.Error == nil || attempt == {{$.Retries}} || !retryable{{$.ServiceName}}(call.Error) {
+               break
+           }
+
+           select {
+           case <-{{.ContextName}}.Done():
+               return {{.ContextName}}.Err()
+           case <-time.After(backoff{{$.ServiceName}}(attempt)):
+           }
+
+           if err := c.redial(client); err != nil {
+               return fmt.Errorf("{{$.PackageName}}.{{$.ServiceName}}Client.{{.Name}} redial error: %w", err)
+           }
+       }
+
+       if call.Error != nil {
+           return {{if $.TypedErrors}}&RPCError{Method: Method{{$.ServiceName}}{{.Name}}, Err: call.Error}{{else}}fmt.Errorf("{{$.PackageName}}.{{$.ServiceName}}Client.{{.Name}} Call error: %w", call.Error){{end}}
+       }
+
+       return nil
+{{- else}}
+       call := {{if $.Swappable}}c.rpcClient(){{else}}c.client{{end}}.Go(Method{{$.ServiceName}}{{.Name}}, args, response, make(chan *rpc.Call, 1))
+       select {
+       case <-{{.ContextName}}.Done():
+           // The call completes in the background; its buffered Done channel never blocks.
+           return {{.ContextName}}.Err()
+       case call = <-call.Done:
+           if call.Error != nil {
+               return {{if $.TypedErrors}}&RPCError{Method: Method{{$.ServiceName}}{{.Name}}, Err: call.Error}{{else}}fmt.Errorf("{{$.PackageName}}.{{$.ServiceName}}Client.{{.Name}} Call error: %w", call.Error){{end}}
+           }
+       }
+
+       return nil
+{{- end}}
+   })
+   if err != nil {
+       return {{if .HasResponse}}{{template "zero" .}}, {{end}}err
+   }
+
+   return {{if .HasResponse}}{{if not .ResponsePointer}}*{{end}}response, {{end}}nil
+}
+{{if $.Async}}
+// {{.Name}}Async starts {{.Name}} and returns the pending call; its Reply is a *{{.ResponseType}}.
+func (c *{{$.ServiceName}}Client) {{.Name}}Async({{template "params" .}}) *rpc.Call {
+   return {{if $.Swappable}}c.rpcClient(){{else}}c.client{{end}}.Go(Method{{$.ServiceName}}{{.Name}}, {{if $.Metadata}}{{$.ServiceName}}Envelope[{{.RequestType}}]{Payload: {{template "request" .}}}{{else}}{{template "request" .}}{{end}}, new({{.ResponseType}}), make(chan *rpc.Call, 1))
+}
+{{end}}
+{{end}}
+
+{{if .ExposeConn}}
+// Conn returns the underlying *rpc.Client for calls the generated methods do not cover.
+func (c *{{.ServiceName}}Client) Conn() *rpc.Client {
+{{- if .Swappable}}
+   return c.rpcClient()
+{{- else}}
+   return c.client
+{{- end}}
+}
+{{end}}
+
+{{if .Stringer}}
+// String identifies the client in logs by its service and remote address.
+func (c *{{.ServiceName}}Client) String() string {
+{{- if .Swappable}}
+   c.mu.Lock()
+   defer c.mu.Unlock()
+{{end}}
+   if c.address == "" {
+       return "{{.RPCName}} client"
+   }
+
+   return "{{.RPCName}} client of " + c.address
+}
+{{end}}
+
+{{if .MethodsAccessor}}
+// Methods returns the names of the RPC methods the client calls.
+func (c *{{.ServiceName}}Client) Methods() []string {
+   return []string{
+{{- range .Methods}}
+       Method{{$.ServiceName}}{{.Name}},
+{{- end}}
+   }
+}
+{{end}}
+
+{{if ne .CloseName "Close"}}
+// {{.CloseName}} closes the connection; the interface declares its own Close method.
+{{end -}}
+func (c *{{.ServiceName}}Client) {{.CloseName}}() error {
+{{- if .Swappable}}
+   c.mu.Lock()
+   defer c.mu.Unlock()
+
+   c.closed = true
+{{- end}}
+   return c.client.Close()
+}
+
+{{if .Pool}}
+{{if .Assert}}
+var _ {{.ServiceType}} = (*{{.ServiceName}}Pool)(nil)
+{{end}}
+
+// {{.ServiceName}}Pool spreads calls round-robin over {{.Pool}} clients connected to one
+// address, reducing head-of-line blocking on a single connection. Each client is
+// dialed the first time it is picked.
+type {{.ServiceName}}Pool struct {
+   address string
+   opts    []{{.ServiceName}}ClientOption
+   next    atomic.Uint64
+
+   // mu guards clients and closed; it is not held while dialing.
+   mu      sync.Mutex
+   clients [{{.Pool}}]*{{.ServiceName}}Client
+   closed  bool
+}
+
+// New{{.ServiceName}}Pool returns a pool dialing address with New{{.ServiceName}}Client and opts.
+func New{{.ServiceName}}Pool(address string, opts ...{{.ServiceName}}ClientOption) *{{.ServiceName}}Pool {
+   return &{{.ServiceName}}Pool{address: address, opts: opts}
+}
+
+// client returns the next client in turn, dialing it if it is not connected yet.
+{{- if ne .Network "http"}} Dialing gives up when ctx is done.{{end}}
+func (p *{{.ServiceName}}Pool) client(ctx context.Context) (*{{.ServiceName}}Client, error) {
+   i := (p.next.Add(1) - 1) % uint64(len(p.clients))
+
+   p.mu.Lock()
+   closed, client := p.closed, p.clients[i]
+   p.mu.Unlock()
+
+   if closed {
+       return nil, rpc.ErrShutdown
+   }
+
+   if client != nil {
+       return client, nil
+   }
+
+{{- if eq .Network "http"}}
+   client, err := New{{.ServiceName}}Client(p.address, p.opts...)
+{{- else}}
+   client, err := dial{{.ServiceName}}Client(ctx, p.address, p.opts)
+{{- end}}
+   if err != nil {
+       return nil, fmt.Errorf("{{$.PackageName}}.{{.ServiceName}}Pool dial error: %w", err)
+   }
+
+   p.mu.Lock()
+   defer p.mu.Unlock()
+
+   // The pool may have been closed, or the slot filled by a concurrent call, while dialing.
+   if p.closed {
+       _ = client.{{.CloseName}}()
+       return nil, rpc.ErrShutdown
+   }
+
+   if p.clients[i] != nil {
+       _ = client.{{.CloseName}}()
+       return p.clients[i], nil
+   }
+
+   p.clients[i] = client
+
+   return client, nil
+}
+
+{{range .Methods}}
+func (p *{{$.ServiceName}}Pool) {{template "signature" .}} {
+   client, err := p.client({{if .ContextType}}context.Background(){{else}}{{.ContextName}}{{end}})
+   if err != nil {
+       return {{if .HasResponse}}{{template "zero" .}}, {{end}}err
+   }
+
+   return client.{{.Name}}({{if .ContextType}}*new({{.ContextType}}){{else}}{{.ContextName}}{{end}}
+{{- if .Params}}{{range .Params}}, {{.Name}}{{if .Variadic}}...{{end}}{{end}}{{else if .HasRequest}}, {{.RequestName}}{{if .Variadic}}...{{end}}{{end}})
+}
+{{end}}
+
+// {{.CloseName}} closes every connection the pool has dialed.
+func (p *{{.ServiceName}}Pool) {{.CloseName}}() error {
+   p.mu.Lock()
+   defer p.mu.Unlock()
+
+   p.closed = true
+
+   var errs []error
+   for _, client := range p.clients {
+       if client != nil {
+           errs = append(errs, client.{{.CloseName}}())
+       }
+   }
+
+   return errors.Join(errs...)
+}
+{{end}}
+`
+
+const serverTemplate = `
+// Code generated by rpc-gen; DO NOT EDIT.
+// Source: {{.SourceFile}} ({{.ServiceName}})
+
+package {{.PackageName}}
+
+import (
+{{range .StdImports}}   "{{.Path}}"
+{{end}}
+{{range .Imports}}   {{.Name}} "{{.Path}}"
+{{end}})
+
+type {{.ServiceName}}Server struct {
+   impl {{.ServiceType}}
+
+   // BaseContext optionally returns the context passed to each call of the
+   // implementation. If nil, context.Background() is used.
+   BaseContext func() context.Context
+}
+
+func New{{.ServiceName}}Server(impl {{.ServiceType}}) *{{.ServiceName}}Server {
+   return &{{.ServiceName}}Server{impl: impl}
+}
+
+func Register{{.ServiceName}}Server(server *{{.ServiceName}}Server) error {
+   if err := rpc.RegisterName("{{.RPCName}}", server); err != nil {
+       return fmt.Errorf("{{$.PackageName}}.Register{{.ServiceName}}Server rpc.RegisterName error: %w", err)
+   }
+
+   return nil
+}
+
+// Serve{{.ServiceName}} accepts connections on l and serves the services registered
+// with rpc.DefaultServer, such as by Register{{.ServiceName}}Server, until Accept fails.
+{{- if eq .Network "http"}}
+func Serve{{.ServiceName}}(l net.Listener) error {
+   if err := http.Serve(l, rpc.DefaultServer); err != nil {
+       return fmt.Errorf("{{$.PackageName}}.Serve{{.ServiceName}} http.Serve error: %w", err)
+   }
+
+   return nil
+}
+{{- else}}
+func Serve{{.ServiceName}}(l net.Listener) error {
+   for {
+       conn, err := l.Accept()
+       if err != nil {
+           return fmt.Errorf("{{$.PackageName}}.Serve{{.ServiceName}} Accept error: %w", err)
+       }
+{{if eq .Codec "json"}}
+       go rpc.ServeCodec(jsonrpc.NewServerCodec(conn))
+{{- else}}
+       go rpc.ServeConn(conn)
+{{- end}}
+   }
+}
+{{- end}}
+
+{{- if .Pipe}}
+
+// New{{.ServiceName}}PipeClient serves impl on a private rpc.Server over one end of a
+// net.Pipe and returns a client connected to the other end, for tests exercising
+// the generated client and server together in memory.
+func New{{.ServiceName}}PipeClient(impl {{.ServiceType}}, opts ...{{.ServiceName}}ClientOption) (*{{.ServiceName}}Client, error) {
+   server := rpc.NewServer()
+   if err := server.RegisterName("{{.RPCName}}", New{{.ServiceName}}Server(impl)); err != nil {
+       return nil, fmt.Errorf("{{$.PackageName}}.New{{.ServiceName}}PipeClient rpc.RegisterName error: %w", err)
+   }
+
+   serverConn, clientConn := net.Pipe()
+{{- if eq .Codec "json"}}
+   go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+{{- else}}
+   go server.ServeConn(serverConn)
+{{- end}}
+
+   return New{{.ServiceName}}ClientFromConn(clientConn, opts...), nil
+}
+{{- end}}
+
+func (s *{{.ServiceName}}Server) baseContext() context.Context {
+   if s.BaseContext == nil {
+       return context.Background()
+   }
+
+   return s.BaseContext()
+}
+
+{{if .Metadata}}
+// {{.ServiceName}}Envelope carries a request of a {{.ServiceName}} method with the metadata of
+// the caller's context.
+type {{.ServiceName}}Envelope[T any] struct {
+   Meta    map[string]string
+   Payload T
+}
+
+// {{.ServiceName}}MetadataKey is the context key of the metadata sent with {{.ServiceName}} calls.
+type {{.ServiceName}}MetadataKey struct{}
+
+// With{{.ServiceName}}Metadata returns a copy of ctx carrying md. {{.ServiceName}}Client sends it
+// with each call made with the context, and {{.ServiceName}}Server passes it on to the
+// implementation in the same way.
+func With{{.ServiceName}}Metadata(ctx context.Context, md map[string]string) context.Context {
+   return context.WithValue(ctx, {{.ServiceName}}MetadataKey{}, md)
+}
+
+// {{.ServiceName}}MetadataFrom returns the metadata carried by ctx, or nil.
+func {{.ServiceName}}MetadataFrom(ctx context.Context) map[string]string {
+   md, _ := ctx.Value({{.ServiceName}}MetadataKey{}).(map[string]string)
+
+   return md
+}
+{{end}}
+
+{{range .Methods}}
+{{- $ctx := "s.baseContext()"}}
+{{- $request := "request"}}
+{{- if .ContextType}}{{$ctx = printf "*new(%s)" .ContextType}}{{else if $.Metadata}}{{$ctx = printf "With%sMetadata(s.baseContext(), request.Meta)" $.ServiceName}}{{end}}
+{{- if $.Metadata}}{{$request = "request.Payload"}}{{end}}
+func (s *{{$.ServiceName}}Server) {{.Name}}(request {{if $.Metadata}}{{$.ServiceName}}Envelope[{{.RequestType}}]{{else}}{{.RequestType}}{{end}}, response *{{.ResponseType}}) error {
+{{- if .HasResponse}}
+   resp, err := s.impl.{{.Name}}({{$ctx}}{{if .Params}}{{range .Params}}, {{$request}}.{{.Field}}{{if .Variadic}}...{{end}}{{end}}{{else if .HasRequest}}, {{$request}}{{if .Variadic}}...{{end}}{{end}})
+   if err != nil {
+       return err
+   }
+
+{{- if .ResponsePointer}}
+   if resp != nil {
+       *response = *resp
+   }
+{{- else}}
+   *response = resp
+{{- end}}
+
+   return nil
+{{- else}}
+   return s.impl.{{.Name}}({{$ctx}}{{if .Params}}{{range .Params}}, {{$request}}.{{.Field}}{{if .Variadic}}...{{end}}{{end}}{{else if .HasRequest}}, {{$request}}{{if .Variadic}}...{{end}}{{end}})
+{{- end}}
+}
+{{end}}
+`
+
+const typesTemplate = `
+// Code generated by rpc-gen; DO NOT EDIT.
+// Source: {{.SourceFile}} ({{.ServiceName}})
+
+package {{.PackageName}}
+
+import (
+{{range .StdImports}}   "{{.Path}}"
+{{end}}
+{{range .Imports}}   {{.Name}} "{{.Path}}"
+{{end}})
+
+{{range .Methods}}
+{{- if .Params}}
+// {{.RequestType}} carries the arguments of {{$.ServiceName}}.{{.Name}}.
+type {{.RequestType}} struct {
+{{- range .Params}}
+   {{.Field}} {{.Type}}
+{{- end}}
+}
+{{end}}
+{{- end}}
+`
+
+// Param is a positional argument of a method taking several arguments after the
+// context, which are packed into a synthesized request struct.
+type Param struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+	// Type is the field type; a variadic parameter is packed into a slice.
+	Type     string `json:"type"`
+	Variadic bool   `json:"variadic"`
+}
+
+type Method struct {
+	// Doc holds the comment lines of the interface method, including their markers.
+	Doc  []string `json:"doc"`
+	Name string   `json:"name"`
+	// ContextName and RequestName are the parameter names used in the interface.
+	ContextName string `json:"contextName"`
+	// ContextType is the type of the first parameter when Config.LooseContext accepts
+	// one other than context.Context, and empty otherwise.
+	ContextType string `json:"contextType"`
+	HasRequest  bool   `json:"hasRequest"`
+	// Variadic is set when the last parameter is variadic; RequestType or its Param is then a slice.
+	Variadic    bool    `json:"variadic"`
+	RequestName string  `json:"requestName"`
+	RequestType string  `json:"requestType"`
+	Params      []Param `json:"params"`
+	HasResponse bool    `json:"hasResponse"`
+	// ResponsePointer is set when the interface returns *ResponseType rather than ResponseType.
+	ResponsePointer bool     `json:"responsePointer"`
+	ResponseType    string   `json:"responseType"`
+	GobTypes        []string `json:"gobTypes"`
+	// Timeout bounds calls whose context has no deadline, from //rpc-gen:timeout.
+	Timeout time.Duration `json:"timeout"`
+	// Source is the file:line the method is declared at.
+	Source string `json:"source"`
+}
+
+// Import is an import referenced by qualified request or response types.
+// Name is only set when the package is imported under an alias; PackageName is
+// the name the package declares.
+type Import struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	PackageName string `json:"packageName"`
+}
+
+// ident returns the identifier the generated code refers to the import by.
+func (imp Import) ident() string {
+	if imp.Name != "" {
+		return imp.Name
+	}
+
+	return imp.PackageName
+}
+
+// stdImport returns the Import of the standard library package at path.
+func stdImport(path string) Import {
+	return Import{Path: path, PackageName: path[strings.LastIndex(path, "/")+1:]}
+}
+
+// Options are the generator flags that affect the generated code.
+type Options struct {
+	Assert      bool          `json:"assert"`
+	Network     string        `json:"network"`
+	HTTPPath    string        `json:"httpPath"`
+	Codec       string        `json:"codec"`
+	TLS         bool          `json:"tls"`
+	Async       bool          `json:"async"`
+	DialTimeout time.Duration `json:"dialTimeout"`
+	NoRegister  bool          `json:"noRegister"`
+	Retries     int           `json:"retries"`
+	Reconnect   bool          `json:"reconnect"`
+	Redial      bool          `json:"redial"`
+	ExposeConn  bool          `json:"exposeConn"`
+	// ContextDial emits New<Service>ClientContext, dialing with a context.
+	ContextDial bool `json:"contextDial"`
+	// Pool emits <Service>Pool, spreading calls over this many connections.
+	Pool int `json:"pool"`
+	// Metadata wraps requests in <Service>Envelope with metadata taken from the context.
+	Metadata bool `json:"metadata"`
+	// TypedErrors returns failed calls as *RPCError.
+	TypedErrors bool `json:"typedErrors"`
+	// Stringer emits a String method naming the service and remote address.
+	Stringer bool `json:"stringer"`
+	// MethodsAccessor emits a Methods method listing the RPC method names.
+	MethodsAccessor bool `json:"methodsAccessor"`
+	// Pipe emits New<Service>PipeClient, serving an implementation over net.Pipe.
+	Pipe bool `json:"pipe"`
+	// Header is the -header prologue written before the generated-code marker.
+	Header string `json:"header"`
+
+	ClientIface       bool   `json:"clientIface"`
+	ClientIfaceSuffix string `json:"clientIfaceSuffix"`
+}
+
+// Swappable reports whether the client's connection may be replaced after it is
+// created, so that the client guards it with a mutex.
+func (o Options) Swappable() bool {
+	return o.Reconnect || o.Redial
+}
+
+type ServiceData struct {
+	Options `json:"options"`
+
+	PackageName string `json:"packageName"`
+	ServiceName string `json:"serviceName"`
+	// RPCName is the name the service is registered under, from //rpc-gen:name or ServiceName.
+	RPCName string `json:"rpcName"`
+	// ServiceDoc holds the doc comment lines of the interface, carried onto the client.
+	ServiceDoc []string `json:"serviceDoc"`
+	// ServiceType refers to the interface, qualified when generating outside its package.
+	ServiceType string `json:"serviceType"`
+	FilePath    string `json:"filePath"`
+	// SourceFile is FilePath relative to OutputDir, as recorded in the generated header.
+	SourceFile string   `json:"sourceFile"`
+	OutputDir  string   `json:"outputDir"`
+	Imports    []Import `json:"imports"`
+	// StdImports are the standard library packages the built-in template of the
+	// file being generated uses; they are set by the generate functions.
+	StdImports []Import `json:"-"`
+	Methods    []Method `json:"methods"`
+	// DeclareRPCError is set on one service with TypedErrors per output package, whose
+	// client file declares the RPCError type shared by the others.
+	DeclareRPCError bool `json:"-"`
+	// CloseName names the client method closing the connection, renamed when the
+	// interface declares a method called Close.
+	CloseName string   `json:"closeName"`
+	GobTypes  []string `json:"gobTypes"`
+}
+
+const (
+	directivePrefix  = "//rpc-gen:"
+	serviceDirective = "service"
+	nameDirective    = "name"
+	ignoreDirective  = "ignore"
+	timeoutDirective = "timeout"
+	prefixDirective  = "prefix"
+)
+
+func (g *generator) log(level slog.Level, format string, args ...any) {
+	g.cfg.Logger.Log(context.Background(), level, format, args...)
+}
+
+// validRPCName reports whether name can prefix the method names of a net/rpc service,
+// such as "Accounts" or "account.v1.Accounts".
+func validRPCName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+		return false
+	}
+
+	return !strings.ContainsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '`' || r == '\\'
+	})
+}
+
+// parseDirectives returns the //rpc-gen:key[=value] directives found in doc.
+func parseDirectives(doc *ast.CommentGroup) map[string]string {
+	directives := make(map[string]string)
+	if doc == nil {
+		return directives
+	}
+
+	for _, comment := range doc.List {
+		directive, ok := strings.CutPrefix(comment.Text, directivePrefix)
+		if !ok {
+			continue
+		}
+
+		key, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		directives[key] = value
+	}
+
+	return directives
+}
+
+// extractDoc returns the lines of doc as written, leaving out //rpc-gen: directives.
+func extractDoc(doc *ast.CommentGroup) []string {
+	if doc == nil {
+		return nil
+	}
+
+	var lines []string
+	for _, comment := range doc.List {
+		if strings.HasPrefix(comment.Text, directivePrefix) {
+			continue
+		}
+
+		lines = append(lines, comment.Text)
+	}
+
+	// Drop the blank comment lines left before the directives that were removed.
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "//" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// extractTypeName renders expr as Go source. When generating outside the source
+// package, qualifier is its package name and prefixes the types it declares.
+func extractTypeName(expr ast.Expr, qualifier string) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if qualifier != "" && types.Universe.Lookup(t.Name) == nil {
+			return qualifier + "." + t.Name
+		}
+
+		return t.Name
+	case *ast.StarExpr:
+		return "*" + extractTypeName(t.X, qualifier)
+	case *ast.SelectorExpr:
+		return extractTypeName(t.X, "") + "." + t.Sel.Name
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return "[]" + extractTypeName(t.Elt, qualifier)
+		}
+
+		return "[" + types.ExprString(t.Len) + "]" + extractTypeName(t.Elt, qualifier)
+	case *ast.MapType:
+		return "map[" + extractTypeName(t.Key, qualifier) + "]" + extractTypeName(t.Value, qualifier)
+	case *ast.Ellipsis:
+		return "[]" + extractTypeName(t.Elt, qualifier)
+	case *ast.IndexExpr:
+		return extractTypeName(t.X, qualifier) + "[" + extractTypeName(t.Index, qualifier) + "]"
+	case *ast.IndexListExpr:
+		args := make([]string, len(t.Indices))
+		for i, index := range t.Indices {
+			args[i] = extractTypeName(index, qualifier)
+		}
+
+		return extractTypeName(t.X, qualifier) + "[" + strings.Join(args, ", ") + "]"
+	default:
+		return "unknown"
+	}
+}
+
+// Diagnostic records why an interface method was left out of the generated code.
+type Diagnostic struct {
+	Pos     token.Position
+	Service string
+	Method  string
+	Reason  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d: %s.%s %s", d.Pos.Filename, d.Pos.Line, d.Service, d.Method, d.Reason)
+}
+
+func (g *generator) reportInvalid(pos token.Position, fileName, serviceName, methodName, reason string) {
+	pos.Filename = fileName
+
+	g.log(slog.LevelWarn, reason,
+		slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
+			fileName, pos.Line, pos.Column, serviceName, methodName),
+		))
+
+	g.diagnostics = append(g.diagnostics, Diagnostic{
+		Pos:     pos,
+		Service: serviceName,
+		Method:  methodName,
+		Reason:  reason,
+	})
+}
+
+// astParam is a single parameter of a function type; grouped names such as
+// "a, b int" are split into one astParam each.
+type astParam struct {
+	name string
+	typ  ast.Expr
+}
+
+func flattenParams(fields *ast.FieldList) []astParam {
+	var params []astParam
+
+	for _, field := range fields.List {
+		if len(field.Names) == 0 {
+			params = append(params, astParam{typ: field.Type})
+			continue
+		}
+
+		for _, name := range field.Names {
+			params = append(params, astParam{name: name.Name, typ: field.Type})
+		}
+	}
+
+	return params
+}
+
+// reservedNames are identifiers the generated method bodies declare themselves.
+var reservedNames = []string{"c", "s", "p", "ctx", "call", "request", "response", "resp", "err", "cancel", "client", "attempt", "args"}
+
+// templatePackages are the identifiers of the standard library packages the templates import.
+var templatePackages = []string{"context", "fmt", "net", "rpc", "jsonrpc", "http", "time", "tls", "gob", "errors", "io", "syscall", "sync", "atomic"}
+
+// isReserved reports whether a parameter called name would shadow an identifier the
+// generated method bodies use, including the packages in imports.
+func isReserved(name string, imports []Import) bool {
+	return slices.Contains(reservedNames, name) || slices.Contains(templatePackages, name) ||
+		slices.ContainsFunc(imports, func(imp Import) bool { return imp.ident() == name })
+}
+
+// paramIdent returns name for use in generated code, or fallback when the
+// interface leaves the parameter unnamed.
+func paramIdent(name, fallback string, imports []Import) string {
+	switch {
+	case name == "" || name == "_":
+		return fallback
+	case name != fallback && isReserved(name, imports):
+		return name + "Arg"
+	default:
+		return name
+	}
+}
+
+// paramName returns the identifier for the i-th packed argument in generated code.
+func paramName(name string, i int, imports []Import) string {
+	switch {
+	case name == "" || name == "_":
+		return fmt.Sprintf("arg%d", i)
+	case isReserved(name, imports):
+		return name + "Arg"
+	default:
+		return name
+	}
+}
+
+// fieldName returns the exported request struct field for the i-th packed argument.
+func fieldName(name string, i int) string {
+	if name == "" || name == "_" {
+		return fmt.Sprintf("Arg%d", i)
+	}
+
+	r, size := utf8.DecodeRuneInString(name)
+
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
+// isExportedType reports whether every named type in expr is exported or predeclared,
+// as gob and net/rpc require.
+func isExportedType(expr ast.Expr) bool {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return ast.IsExported(t.Name) || types.Universe.Lookup(t.Name) != nil
+	case *ast.StarExpr:
+		return isExportedType(t.X)
+	case *ast.SelectorExpr:
+		return ast.IsExported(t.Sel.Name)
+	case *ast.ArrayType:
+		return isExportedType(t.Elt)
+	case *ast.MapType:
+		return isExportedType(t.Key) && isExportedType(t.Value)
+	case *ast.Ellipsis:
+		return isExportedType(t.Elt)
+	case *ast.IndexExpr:
+		return isExportedType(t.X) && isExportedType(t.Index)
+	case *ast.IndexListExpr:
+		return isExportedType(t.X) && !slices.ContainsFunc(t.Indices, func(index ast.Expr) bool { return !isExportedType(index) })
+	default:
+		return true
+	}
+}
+
+// isContextSelector reports whether selector is Context from the package imported
+// as "context", whatever name the file imports it under.
+func isContextSelector(info *types.Info, selector *ast.SelectorExpr) bool {
+	ident, ok := selector.X.(*ast.Ident)
+	if !ok || selector.Sel.Name != "Context" {
+		return false
+	}
+
+	pkgName, ok := info.Uses[ident].(*types.PkgName)
+
+	return ok && pkgName.Imported().Path() == "context"
+}
+
+// isUnresolvedContext reports whether selector is context.Context written in a file
+// that does not import context, so the name resolves to nothing.
+func isUnresolvedContext(info *types.Info, selector *ast.SelectorExpr) bool {
+	ident, ok := selector.X.(*ast.Ident)
+	if !ok || ident.Name != "context" || selector.Sel.Name != "Context" {
+		return false
+	}
+
+	_, ok = info.Uses[ident]
+
+	return !ok
+}
+
+// isInterfaceType reports whether expr, with any pointers removed, is an interface type,
+// which gob cannot encode without registering the concrete values.
+func isInterfaceType(info *types.Info, expr ast.Expr) bool {
+	typ := info.TypeOf(expr)
+	if typ == nil {
+		return false
+	}
+
+	for {
+		pointer, ok := typ.(*types.Pointer)
+		if !ok {
+			break
+		}
+
+		typ = pointer.Elem()
+	}
+
+	return types.IsInterface(typ)
+}
+
+// isUnencodableType reports whether expr, with any pointers removed, is a func or chan
+// type, such as context.CancelFunc, which gob cannot encode.
+func isUnencodableType(info *types.Info, expr ast.Expr) bool {
+	typ := info.TypeOf(expr)
+	if typ == nil {
+		return false
+	}
+
+	for {
+		pointer, ok := typ.Underlying().(*types.Pointer)
+		if !ok {
+			break
+		}
+
+		typ = pointer.Elem()
+	}
+
+	switch typ.Underlying().(type) {
+	case *types.Signature, *types.Chan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *generator) validateMethodSignature(fset *token.FileSet, info *types.Info, fileName, serviceName, methodName string, method *ast.Field, funcType *ast.FuncType) bool {
+	if !token.IsExported(methodName) {
+		g.reportInvalid(fset.Position(method.Pos()), fileName, serviceName, methodName, "is unexported; net/rpc only serves exported methods")
+		return false
+	}
+
+	if funcType == nil {
+		// funcType is nil here, so report the position of the interface method itself.
+		g.reportInvalid(fset.Position(method.Pos()), fileName, serviceName, methodName, "is not a valid function")
+		return false
+	}
+
+	if funcType.Params == nil {
+		g.reportInvalid(fset.Position(funcType.Pos()), fileName, serviceName, methodName, "has no parameters")
+		return false
+	}
+
+	if len(funcType.Params.List) == 0 {
+		g.reportInvalid(fset.Position(funcType.Pos()), fileName, serviceName, methodName, "has no parameters")
+		return false
+	}
+
+	if len(funcType.Params.List[0].Names) > 1 {
+		g.reportInvalid(fset.Position(funcType.Params.List[0].Pos()), fileName, serviceName, methodName, "first parameter must be a single context.Context")
+		return false
+	}
+
+	// With LooseContext, a pointer to a qualified type such as *testing.T is accepted too.
+	firstType := funcType.Params.List[0].Type
+	if star, ok := firstType.(*ast.StarExpr); ok && g.cfg.LooseContext {
+		firstType = star.X
+	}
+
+	ctxSelector, ok := firstType.(*ast.SelectorExpr)
+	if !ok {
+		g.reportInvalid(fset.Position(funcType.Params.List[0].Pos()), fileName, serviceName, methodName, "first parameter must be context.Context")
+		return false
+	}
+
+	if isUnresolvedContext(info, ctxSelector) {
+		g.reportInvalid(fset.Position(funcType.Params.List[0].Pos()), fileName, serviceName, methodName, `first parameter is context.Context but the file does not import "context"`)
+		return false
+	}
+
+	if !isContextSelector(info, ctxSelector) && !g.cfg.LooseContext {
+		g.reportInvalid(fset.Position(funcType.Params.List[0].Pos()), fileName, serviceName, methodName, "first parameter must be context.Context")
+		return false
+	}
+
+	if funcType.Results == nil {
+		g.reportInvalid(fset.Position(funcType.Pos()), fileName, serviceName, methodName, "has no return values")
+		return false
+	}
+
+	if len(funcType.Results.List) != 1 && len(funcType.Results.List) != 2 {
+		g.reportInvalid(fset.Position(funcType.Pos()), fileName, serviceName, methodName, "does not have one or two return values")
+		return false
+	}
+
+	for _, param := range flattenParams(funcType.Params)[1:] {
+		if !isExportedType(param.typ) {
+			g.reportInvalid(fset.Position(param.typ.Pos()), fileName, serviceName, methodName, "request type must be exported")
+			return false
+		}
+
+		if isInterfaceType(info, param.typ) {
+			g.reportInvalid(fset.Position(param.typ.Pos()), fileName, serviceName, methodName, "request type must be concrete, not an interface")
+			return false
+		}
+
+		if isUnencodableType(info, param.typ) {
+			g.reportInvalid(fset.Position(param.typ.Pos()), fileName, serviceName, methodName, "request type must be encodable, not a func or chan")
+			return false
+		}
+	}
+
+	// The generated client allocates the reply with new, so only one level of indirection is supported.
+	if star, ok := funcType.Results.List[0].Type.(*ast.StarExpr); ok && len(funcType.Results.List) == 2 {
+		if _, ok := star.X.(*ast.StarExpr); ok {
+			g.reportInvalid(fset.Position(funcType.Results.List[0].Pos()), fileName, serviceName, methodName, "response type must be T or *T, not a pointer to a pointer")
+			return false
+		}
+	}
+
+	if len(funcType.Results.List) == 2 && !isExportedType(funcType.Results.List[0].Type) && responseAlias(info, funcType) == nil {
+		g.reportInvalid(fset.Position(funcType.Results.List[0].Pos()), fileName, serviceName, methodName, "response type must be exported")
+		return false
+	}
+
+	if len(funcType.Results.List) == 2 && isUnencodableType(info, funcType.Results.List[0].Type) {
+		g.reportInvalid(fset.Position(funcType.Results.List[0].Pos()), fileName, serviceName, methodName, "response type must be encodable, not a func or chan")
+		return false
+	}
+
+	errResult := funcType.Results.List[len(funcType.Results.List)-1]
+	// Aliases of error are accepted since the generated methods return the identical type.
+	if errType := info.TypeOf(errResult.Type); errType == nil || !types.Identical(errType, types.Universe.Lookup("error").Type()) {
+		g.reportInvalid(fset.Position(errResult.Pos()), fileName, serviceName, methodName, "last return value is not error")
+		return false
+	}
+
+	return true
+}
+
+// collectInterfaces indexes the package-level interface declarations of files by name.
+func collectInterfaces(files []*ast.File) map[string]*ast.InterfaceType {
+	interfaces := make(map[string]*ast.InterfaceType)
+
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
+			}
+
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				if interfaceType, ok := typeSpec.Type.(*ast.InterfaceType); ok {
+					interfaces[typeSpec.Name.Name] = interfaceType
+				}
+			}
+		}
+	}
+
+	return interfaces
+}
+
+// collectImports returns the imports referenced by qualified types in interfaceType,
+// including those of embedded interfaces declared in the package.
+func collectImports(pkg *types.Package, info *types.Info, interfaceType *ast.InterfaceType, interfaces map[string]*ast.InterfaceType) []Import {
+	seen := make(map[string]Import)
+	aliased := make(map[string]Import)
+
+	var walk func(interfaceType *ast.InterfaceType)
+	walk = func(interfaceType *ast.InterfaceType) {
+		for _, method := range interfaceType.Methods.List {
+			if len(method.Names) == 0 {
+				if embeddedType, ok := interfaces[extractTypeName(method.Type, "")]; ok {
+					walk(embeddedType)
+				}
+
+				continue
+			}
+
+			ast.Inspect(method.Type, func(n ast.Node) bool {
+				selector, ok := n.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+
+				ident, ok := selector.X.(*ast.Ident)
+				if !ok {
+					return true
+				}
+
+				pkgName, ok := info.Uses[ident].(*types.PkgName)
+				if !ok {
+					return true
+				}
+
+				imp := Import{Path: pkgName.Imported().Path(), PackageName: pkgName.Imported().Name()}
+				if pkgName.Name() != pkgName.Imported().Name() {
+					imp.Name = pkgName.Name()
+				}
+
+				seen[imp.Path] = imp
+
+				return false
+			})
+
+			// Aliased responses are referred to by their target, which may live in a
+			// package the interface does not import.
+			if target := responseAlias(info, method.Type); target != nil && target.Pkg() != pkg {
+				if _, ok := seen[target.Pkg().Path()]; !ok {
+					aliased[target.Pkg().Path()] = Import{Path: target.Pkg().Path(), PackageName: target.Pkg().Name()}
+				}
+			}
+		}
+	}
+	walk(interfaceType)
+
+	for path, imp := range aliased {
+		if _, ok := seen[path]; !ok {
+			seen[path] = imp
+		}
+	}
+
+	imports := make([]Import, 0, len(seen))
+	for _, imp := range seen {
+		imports = append(imports, imp)
+	}
+
+	slices.SortFunc(imports, func(a, b Import) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return imports
+}
+
+// gobTypeName returns the name of the struct type expr refers to, with any pointers
+// stripped and slices or arrays reduced to their element, so it can be registered
+// with gob. Other types need no registration.
+// Types declared in the source package are qualified with qualifier, so the
+// registrations resolve when generating into another package.
+func gobTypeName(info *types.Info, expr ast.Expr, qualifier string) (string, bool) {
+	for {
+		switch t := expr.(type) {
+		case *ast.StarExpr:
+			expr = t.X
+			continue
+		case *ast.ArrayType:
+			expr = t.Elt
+			continue
+		}
+
+		break
+	}
+
+	typ := info.TypeOf(expr)
+	if typ == nil {
+		return "", false
+	}
+
+	if _, ok := typ.Underlying().(*types.Struct); !ok {
+		return "", false
+	}
+
+	return extractTypeName(expr, qualifier), true
+}
+
+// collectGobTypes returns the distinct gob types of methods in order of first use.
+func collectGobTypes(methods []Method) []string {
+	var gobTypes []string
+
+	for _, method := range methods {
+		for _, gobType := range method.GobTypes {
+			if !slices.Contains(gobTypes, gobType) {
+				gobTypes = append(gobTypes, gobType)
+			}
+		}
+	}
+
+	return gobTypes
+}
+
+// responseAlias returns the type named by the response of methodType when it is an
+// alias, such as "type UserResp = internal.User", of an exported, non-generic named type.
+func responseAlias(info *types.Info, methodType ast.Expr) *types.TypeName {
+	funcType, ok := methodType.(*ast.FuncType)
+	if !ok || funcType.Results == nil || len(funcType.Results.List) != 2 {
+		return nil
+	}
+
+	expr := funcType.Results.List[0].Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+
+	var ident *ast.Ident
+	switch t := expr.(type) {
+	case *ast.Ident:
+		ident = t
+	case *ast.SelectorExpr:
+		ident = t.Sel
+	default:
+		return nil
+	}
+
+	alias, ok := info.Uses[ident].(*types.TypeName)
+	if !ok || !alias.IsAlias() {
+		return nil
+	}
+
+	named, ok := types.Unalias(alias.Type()).(*types.Named)
+	if !ok || named.TypeArgs().Len() > 0 || named.Obj().Pkg() == nil || !named.Obj().Exported() {
+		return nil
+	}
+
+	return named.Obj()
+}
+
+// aliasTargetName returns how generated code refers to target, a type from
+// responseAlias, given the imports of the generated file.
+func aliasTargetName(pkg *types.Package, target *types.TypeName, qualifier string, imports []Import) string {
+	if target.Pkg() == pkg {
+		if qualifier != "" {
+			return qualifier + "." + target.Name()
+		}
+
+		return target.Name()
+	}
+
+	for _, imp := range imports {
+		if imp.Path == target.Pkg().Path() {
+			return imp.ident() + "." + target.Name()
+		}
+	}
+
+	return target.Pkg().Name() + "." + target.Name()
+}
+
+// undefinedType returns the first type name in the parameters or results of funcType
+// that the type checker could not resolve, such as a misspelled request type.
+func undefinedType(info *types.Info, funcType *ast.FuncType) ast.Expr {
+	var undefined ast.Expr
+	for _, field := range slices.Concat(funcType.Params.List, funcType.Results.List) {
+		ast.Inspect(field.Type, func(n ast.Node) bool {
+			if undefined != nil {
+				return false
+			}
+
+			switch n := n.(type) {
+			case *ast.SelectorExpr:
+				if info.Uses[n.Sel] == nil {
+					undefined = n
+				}
+
+				return false
+			case *ast.Ident:
+				if info.Uses[n] == nil && info.Defs[n] == nil {
+					undefined = n
+				}
+			}
+
+			return true
+		})
+	}
+
+	return undefined
+}
+
+func (g *generator) extractMethods(fset *token.FileSet, pkg *types.Package, info *types.Info, fileName, serviceName, qualifier string, imports []Import, interfaceType *ast.InterfaceType, interfaces map[string]*ast.InterfaceType) ([]Method, error) {
+	var methods []Method
+
+	for _, method := range interfaceType.Methods.List {
+		// Embedded interfaces have no names; flatten the ones declared in this package.
+		if len(method.Names) == 0 {
+			pos := fset.Position(method.Pos())
+			embeddedName := extractTypeName(method.Type, "")
+
+			embeddedType, ok := interfaces[embeddedName]
+			if !ok {
+				// The client then lacks the embedded methods, which -strict and the
+				// interface assertion need to know about.
+				g.reportInvalid(pos, fileName, serviceName, embeddedName, "is an embedded interface not declared in the package; its methods are skipped")
+
+				continue
+			}
+
+			g.log(slog.LevelInfo, "Flattening embedded interface",
+				slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
+					fileName, pos.Line, pos.Column, serviceName, embeddedName),
+				))
+
+			embeddedFileName := fset.Position(embeddedType.Pos()).Filename
+			embeddedMethods, err := g.extractMethods(fset, pkg, info, embeddedFileName, serviceName, qualifier, imports, embeddedType, interfaces)
+			if err != nil {
+				return nil, err
+			}
+
+			methods = append(methods, embeddedMethods...)
+
+			continue
+		}
+
+		if funcType, ok := method.Type.(*ast.FuncType); ok {
+			if !g.validateMethodSignature(fset, info, fileName, serviceName, method.Names[0].Name, method, funcType) {
+				continue
+			}
+
+			methodName := method.Names[0].Name
+
+			if g.cfg.MethodFilter != nil && !g.cfg.MethodFilter.MatchString(methodName) {
+				g.log(slog.LevelInfo, "Skipping method not matching the method filter",
+					slog.String("service", serviceName), slog.String("method", methodName))
+
+				continue
+			}
+
+			if undefined := undefinedType(info, funcType); undefined != nil {
+				pos := fset.Position(undefined.Pos())
+				return nil, fmt.Errorf("%s:%d: %s.%s references undefined type %s",
+					fileName, pos.Line, serviceName, methodName, types.ExprString(undefined))
+			}
+
+			var timeout time.Duration
+			if value, ok := parseDirectives(method.Doc)[timeoutDirective]; ok {
+				var err error
+				if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+					pos := fset.Position(method.Pos())
+					return nil, fmt.Errorf("%s:%d: %s.%s has an invalid %s%s directive %q",
+						fileName, pos.Line, serviceName, methodName, directivePrefix, timeoutDirective, value)
+				}
+			}
+
+			// Context-only methods send an empty struct as the request, and methods
+			// with several arguments pack them into a synthesized request struct.
+			args := flattenParams(funcType.Params)[1:]
+			hasRequest := len(args) > 0
+			requestType := "struct{}"
+			var params []Param
+
+			contextName := ""
+			if names := funcType.Params.List[0].Names; len(names) == 1 {
+				contextName = names[0].Name
+			}
+
+			// The client calls with a background context in place of a first parameter
+			// of another type, and the server passes its zero value.
+			var contextType string
+			if ctxSelector, ok := funcType.Params.List[0].Type.(*ast.SelectorExpr); !ok || !isContextSelector(info, ctxSelector) {
+				contextType = extractTypeName(funcType.Params.List[0].Type, "")
+				contextName = "ctx"
+			}
+
+			// A trailing variadic parameter travels as a slice.
+			var variadic bool
+			if hasRequest {
+				_, variadic = args[len(args)-1].typ.(*ast.Ellipsis)
+			}
+
+			var requestName string
+			switch len(args) {
+			case 0:
+			case 1:
+				requestName = paramIdent(args[0].name, "request", imports)
+				requestType = extractTypeName(args[0].typ, qualifier)
+			default:
+				requestType = serviceName + methodName + "Request"
+				for i, arg := range args {
+					params = append(params, Param{
+						Name:     paramName(arg.name, i, imports),
+						Field:    fieldName(arg.name, i),
+						Type:     extractTypeName(arg.typ, qualifier),
+						Variadic: variadic && i == len(args)-1,
+					})
+				}
+			}
+
+			// Error-only methods receive their reply into an empty struct.
+			hasResponse := len(funcType.Results.List) == 2
+			responseType := "struct{}"
+			var responsePointer bool
+			if hasResponse {
+				responseType = extractTypeName(funcType.Results.List[0].Type, qualifier)
+
+				// Remove pointer prefix from response type
+				_, responsePointer = funcType.Results.List[0].Type.(*ast.StarExpr)
+				responseType = strings.TrimPrefix(responseType, "*")
+
+				if target := responseAlias(info, funcType); target != nil {
+					responseType = aliasTargetName(pkg, target, qualifier, imports)
+				}
+			}
+
+			var gobTypes []string
+			if len(params) > 0 {
+				gobTypes = append(gobTypes, requestType)
+			} else if hasRequest {
+				if gobType, ok := gobTypeName(info, args[0].typ, qualifier); ok {
+					gobTypes = append(gobTypes, gobType)
+				}
+			}
+
+			if hasResponse {
+				if _, ok := gobTypeName(info, funcType.Results.List[0].Type, qualifier); ok {
+					gobTypes = append(gobTypes, responseType)
+				}
+			}
+
+			methods = append(methods, Method{
+				Doc:             extractDoc(method.Doc),
+				Name:            methodName,
+				ContextName:     paramIdent(contextName, "ctx", imports),
+				ContextType:     contextType,
+				HasRequest:      hasRequest,
+				Variadic:        variadic,
+				RequestName:     requestName,
+				RequestType:     requestType,
+				Params:          params,
+				HasResponse:     hasResponse,
+				ResponsePointer: responsePointer,
+				ResponseType:    responseType,
+				GobTypes:        gobTypes,
+				Timeout:         timeout,
+				Source:          fmt.Sprintf("%s:%d", fileName, fset.Position(method.Pos()).Line),
+			})
+		}
+	}
+
+	return methods, nil
+}
+
+var templateFuncs = template.FuncMap{
+	"duration": durationLiteral,
+}
+
+// durationLiteral renders d as a Go expression of type time.Duration.
+func durationLiteral(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "0"
+	case d%time.Second == 0:
+		return fmt.Sprintf("%d * time.Second", d/time.Second)
+	case d%time.Millisecond == 0:
+		return fmt.Sprintf("%d * time.Millisecond", d/time.Millisecond)
+	default:
+		return fmt.Sprintf("%d * time.Nanosecond", d)
+	}
+}
+
+// parseClientTemplate parses the client template at path, or the built-in one when
+// path is empty, and checks it executes against a sample service.
+func parseClientTemplate(path string, options Options) (*template.Template, error) {
+	var (
+		temp *template.Template
+		err  error
+	)
+	if path == "" {
+		temp, err = template.New("clientTemplate").Funcs(templateFuncs).Parse(clientTemplate)
+	} else {
+		temp, err = template.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sample := ServiceData{
+		Options:     options,
+		PackageName: "api",
+		ServiceName: "Service",
+		RPCName:     "Service",
+		ServiceType: "Service",
+		FilePath:    "service.go",
+		SourceFile:  "service.go",
+		OutputDir:   ".",
+		Methods: []Method{{
+			Name:            "Method",
+			HasRequest:      true,
+			RequestType:     "Request",
+			HasResponse:     true,
+			ResponsePointer: true,
+			ResponseType:    "Response",
+			GobTypes:        []string{"Request", "Response"},
+		}},
+		GobTypes:  []string{"Request", "Response"},
+		CloseName: "Close",
+	}
+
+	if err := temp.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("error executing template against a sample service: %w", err)
+	}
+
+	return temp, nil
+}
+
+// FileNameData is the data available to the -filename template.
+type FileNameData struct {
+	ServiceName string
+	PackageName string
+	Kind        string
+	Suffix      string
+}
+
+func (g *generator) parseFileNameTemplate(text string) (*template.Template, error) {
+	temp, err := template.New("fileName").Funcs(template.FuncMap{"lower": strings.ToLower}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing filename template: %w", err)
+	}
+
+	// Render a sample of each kind so broken templates fail before anything is written.
+	clientName, err := outputFileName(temp, FileNameData{ServiceName: "Service", PackageName: "pkg", Kind: "client", Suffix: g.cfg.Suffix})
+	if err != nil {
+		return nil, err
+	}
+
+	serverName, err := outputFileName(temp, FileNameData{ServiceName: "Service", PackageName: "pkg", Kind: "server", Suffix: g.cfg.Suffix})
+	if err != nil {
+		return nil, err
+	}
+
+	typesName, err := outputFileName(temp, FileNameData{ServiceName: "Service", PackageName: "pkg", Kind: "types", Suffix: g.cfg.Suffix})
+	if err != nil {
+		return nil, err
+	}
+
+	if clientName == serverName || clientName == typesName || serverName == typesName {
+		return nil, fmt.Errorf("filename template %q must use .Kind to keep client, server and types files apart", text)
+	}
+
+	return temp, nil
+}
+
+func outputFileName(temp *template.Template, data FileNameData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := temp.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("error executing filename template: %w", err)
+	}
+
+	fileName := buf.String()
+	if fileName == "" || fileName == "." || fileName == ".." || filepath.Base(fileName) != fileName {
+		return "", fmt.Errorf("filename template produced invalid file name %q", fileName)
+	}
+
+	return fileName, nil
+}
+
+func (g *generator) generateClientCode(w io.Writer, temp *template.Template, serviceData ServiceData) error {
+	serviceData.StdImports = clientImports(serviceData)
+	serviceData.Imports = withoutStdImports(serviceData.Imports, serviceData.StdImports)
+	if g.cfg.Template == "" {
+		if err := checkImportClash(serviceData); err != nil {
+			return err
+		}
+	}
+
+	return g.generateCode(w, temp, serviceData, g.cfg.Template == "")
+}
+
+func (g *generator) generateServerCode(w io.Writer, temp *template.Template, serviceData ServiceData) error {
+	serviceData.StdImports = serverImports(serviceData)
+	serviceData.Imports = withoutStdImports(serviceData.Imports, serviceData.StdImports)
+	if err := checkImportClash(serviceData); err != nil {
+		return err
+	}
+
+	return g.generateCode(w, temp, serviceData, true)
+}
+
+// generateTypesCode emits the request structs synthesized for methods taking several arguments.
+func (g *generator) generateTypesCode(w io.Writer, temp *template.Template, serviceData ServiceData) error {
+	return g.generateCode(w, temp, serviceData, true)
+}
+
+// clientImports returns the standard library packages used by the built-in client
+// template for serviceData's options.
+func clientImports(serviceData ServiceData) []Import {
+	paths := []string{"context", "fmt", "net", "net/rpc"}
+	if serviceData.Network != "http" {
+		paths = append(paths, "time")
+	}
+
+	if serviceData.Codec == "json" || serviceData.Network != "http" {
+		paths = append(paths, "net/rpc/jsonrpc")
+	}
+
+	if serviceData.Network != "http" {
+		paths = append(paths, "crypto/tls")
+	}
+
+	if serviceData.Codec == "gob" && !serviceData.NoRegister && len(serviceData.GobTypes) > 0 {
+		paths = append(paths, "encoding/gob")
+	}
+
+	if serviceData.Retries > 0 {
+		paths = append(paths, "errors", "io", "syscall", "time")
+	}
+
+	if serviceData.Swappable() {
+		paths = append(paths, "sync")
+	}
+
+	if serviceData.Pool > 0 {
+		paths = append(paths, "errors", "sync", "sync/atomic")
+	}
+
+	if slices.ContainsFunc(serviceData.Methods, func(method Method) bool { return method.Timeout > 0 }) {
+		paths = append(paths, "time")
+	}
+
+	return stdImports(paths)
+}
+
+// serverImports returns the standard library packages used by the server template
+// for serviceData's options.
+func serverImports(serviceData ServiceData) []Import {
+	paths := []string{"context", "fmt", "net", "net/rpc"}
+	if serviceData.Network == "http" {
+		paths = append(paths, "net/http")
+	} else if serviceData.Codec == "json" {
+		paths = append(paths, "net/rpc/jsonrpc")
+	}
+
+	return stdImports(paths)
+}
+
+// checkImportClash reports an import of serviceData named like a standard library
+// package the template declares, such as a package named rpc besides net/rpc.
+func checkImportClash(serviceData ServiceData) error {
+	for _, imp := range serviceData.Imports {
+		i := slices.IndexFunc(serviceData.StdImports, func(stdImp Import) bool { return stdImp.ident() == imp.ident() })
+		if i < 0 {
+			continue
+		}
+
+		return fmt.Errorf("%s: %s refers to %s as %s, which the generated code uses for %s; import it under another name, or set a source package alias if it is the source package",
+			serviceData.FilePath, serviceData.ServiceName, imp.Path, imp.ident(), serviceData.StdImports[i].Path)
+	}
+
+	return nil
+}
+
+// withoutStdImports returns imports without those also in std, which the templates
+// already declare.
+func withoutStdImports(imports, std []Import) []Import {
+	return slices.DeleteFunc(slices.Clone(imports), func(imp Import) bool {
+		return slices.ContainsFunc(std, func(stdImp Import) bool {
+			return stdImp.Path == imp.Path && stdImp.ident() == imp.ident()
+		})
+	})
+}
+
+// stdImports returns the sorted, distinct imports of paths.
+func stdImports(paths []string) []Import {
+	slices.Sort(paths)
+
+	var imports []Import
+	for _, path := range slices.Compact(paths) {
+		imports = append(imports, stdImport(path))
+	}
+
+	return imports
+}
+
+// formatGenerated removes the imports src does not use and formats it. Package
+// references are the identifiers the parser leaves unresolved in selectors.
+func formatGenerated(src []byte, imports []Import) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing generated code: %w", err)
+	}
+
+	used := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if selector, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := selector.X.(*ast.Ident); ok && ident.Obj == nil {
+				used[ident.Name] = true
+			}
+		}
+
+		return true
+	})
+
+	for _, imp := range imports {
+		if !used[imp.ident()] {
+			astutil.DeleteNamedImport(fset, file, imp.Name, imp.Path)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := format.Node(buf, fset, file); err != nil {
+		return nil, fmt.Errorf("error formatting generated code: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// formatSource fixes the imports of src and formats it. When the imports cannot be
+// resolved, src is only formatted and may lack imports the template did not declare.
+func (g *generator) formatSource(src []byte) ([]byte, error) {
+	formatted, importsErr := imports.Process("", src, nil)
+	if importsErr == nil {
+		return formatted, nil
+	}
+
+	formatted, err := format.Source(src)
+	if err != nil {
+		return nil, fmt.Errorf("imports error: %w", errors.Join(importsErr, err))
+	}
+
+	g.log(slog.LevelWarn, "Resolving imports failed, generated imports may be incomplete", slog.String("error", importsErr.Error()))
+
+	return formatted, nil
+}
+
+// generateCode executes temp for serviceData and writes the formatted result to w.
+// Built-in templates declare all their imports, so only the unused ones are removed;
+// the output of a custom template goes through goimports.
+func (g *generator) generateCode(w io.Writer, temp *template.Template, serviceData ServiceData, builtin bool) error {
+	buf := new(bytes.Buffer)
+	if serviceData.Header != "" {
+		fmt.Fprintf(buf, "%s\n\n", strings.TrimRight(serviceData.Header, "\n"))
+	}
+
+	if err := temp.Execute(buf, serviceData); err != nil {
+		return fmt.Errorf("error executing template: %w", err)
+	}
+
+	// Unformatted output is written even when it does not parse, so it can be inspected.
+	if g.cfg.Raw {
+		g.log(slog.LevelWarn, "Writing unformatted code", slog.String("service", serviceData.ServiceName))
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("error writing generated code: %w", err)
+		}
+
+		return nil
+	}
+
+	formatter := g.formatSource
+	if builtin {
+		formatter = func(src []byte) ([]byte, error) {
+			return formatGenerated(src, slices.Concat(serviceData.StdImports, serviceData.Imports))
+		}
+	}
+
+	formatted, err := formatter(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(formatted); err != nil {
+		return fmt.Errorf("error writing generated code: %w", err)
+	}
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// outputKinds lists the kinds of files generated for serviceData.
+func outputKinds(serviceData ServiceData) []string {
+	kinds := []string{"client", "server"}
+	if slices.ContainsFunc(serviceData.Methods, func(method Method) bool { return len(method.Params) > 0 }) {
+		kinds = append(kinds, "types")
+	}
+
+	return kinds
+}
+
+// singleFileNames names the files, before -suffix, shared by all services of a directory with -single-file.
+var singleFileNames = map[string]string{
+	"client": "clients",
+	"server": "servers",
+	"types":  "types",
+}
+
+// outputPath returns the path of the kind file generated for serviceData.
+func (g *generator) outputPath(fileNameTemp *template.Template, serviceData ServiceData, kind string) (string, error) {
+	if g.cfg.SingleFile {
+		return filepath.Join(serviceData.OutputDir, singleFileNames[kind]+g.cfg.Suffix), nil
+	}
+
+	fileName, err := outputFileName(fileNameTemp, FileNameData{
+		ServiceName: serviceData.ServiceName,
+		PackageName: serviceData.PackageName,
+		Kind:        kind,
+		Suffix:      g.cfg.Suffix,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(serviceData.OutputDir, fileName), nil
+}
+
+// checkCollisions reports generated files that more than one service would write,
+// so that one interface cannot silently overwrite the output of another.
+func (g *generator) checkCollisions(fileNameTemp *template.Template, serviceDatas []ServiceData) error {
+	// With -single-file the services of a directory share their files on purpose.
+	if g.cfg.SingleFile {
+		return nil
+	}
+
+	owners := make(map[string]ServiceData)
+
+	var errs []error
+	for _, serviceData := range serviceDatas {
+		for _, kind := range outputKinds(serviceData) {
+			path, err := g.outputPath(fileNameTemp, serviceData, kind)
+			if err != nil {
+				return err
+			}
+
+			key := filepath.Clean(path)
+			if owner, ok := owners[key]; ok {
+				errs = append(errs, fmt.Errorf("%s is generated by both %s (%s) and %s (%s)",
+					path, owner.ServiceName, owner.FilePath, serviceData.ServiceName, serviceData.FilePath))
+
+				continue
+			}
+
+			owners[key] = serviceData
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// openOutput returns where the generated code of kind for serviceData is written:
+// the output file, or standard output preceded by a banner when -stdout is set.
+func (g *generator) openOutput(fileNameTemp *template.Template, serviceData ServiceData, kind string) (io.WriteCloser, error) {
+	path, err := g.outputPath(fileNameTemp, serviceData, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.cfg.Verify {
+		return &verifyWriter{path: path}, nil
+	}
+
+	if g.cfg.Stdout {
+		if _, err := fmt.Fprintf(os.Stdout, "\n// ===== %s %s: %s =====\n\n", serviceData.ServiceName, kind, path); err != nil {
+			return nil, fmt.Errorf("error writing banner: %w", err)
+		}
+
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	// Files written by hand, which lack the rpc-gen header, are only replaced with Force.
+	if !g.cfg.Force {
+		generated, err := isGeneratedFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading file %s: %w", path, err)
+		}
+
+		if err == nil && !generated {
+			return nil, fmt.Errorf("%s exists and was not generated by rpc-gen; use -force to overwrite it", path)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", filepath.Dir(path), err)
+	}
+
+	return &fileWriter{path: path}, nil
+}
+
+// fileWriter collects generated code and, on Close, replaces the file at path with it
+// through a temporary file, so a failed write leaves the previous file in place.
+type fileWriter struct {
+	bytes.Buffer
+	path string
+}
+
+func (w *fileWriter) Close() error {
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), ".rpc-gen-*")
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", w.path, err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.Write(w.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), w.path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error writing file %s: %w", w.path, err)
+	}
+
+	return nil
+}
+
+// ErrStale reports generated code that differs from the files on disk with Config.Verify.
+var ErrStale = errors.New("out of date")
+
+// verifyWriter collects generated code and, on Close, compares it with the file at path.
+type verifyWriter struct {
+	bytes.Buffer
+	path string
+}
+
+func (w *verifyWriter) Close() error {
+	existing, err := os.ReadFile(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w, file is missing", w.path, ErrStale)
+	} else if err != nil {
+		return fmt.Errorf("error reading file %s: %w", w.path, err)
+	}
+
+	if formatted, err := format.Source(existing); err == nil {
+		existing = formatted
+	}
+
+	if bytes.Equal(existing, w.Bytes()) {
+		return nil
+	}
+
+	existingLines := strings.Split(string(existing), "\n")
+	generatedLines := strings.Split(w.String(), "\n")
+
+	line := 1
+	for line <= len(existingLines) && line <= len(generatedLines) && existingLines[line-1] == generatedLines[line-1] {
+		line++
+	}
+
+	return fmt.Errorf("%s: %w, first difference at line %d", w.path, ErrStale, line)
+}
+
+// checkOrphans reports the generated files that -clean would delete because no
+// service produces them anymore.
+func (g *generator) checkOrphans(fileNameTemp *template.Template, serviceDatas []ServiceData) error {
+	expected := make(map[string]bool)
+	for _, serviceData := range serviceDatas {
+		for _, kind := range outputKinds(serviceData) {
+			path, err := g.outputPath(fileNameTemp, serviceData, kind)
+			if err != nil {
+				return err
+			}
+
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+
+			expected[abs] = true
+		}
+	}
+
+	dirs, err := g.outputDirs()
+	if err != nil {
+		return fmt.Errorf("error listing packages to verify: %w", err)
+	}
+
+	var errs []error
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("error reading directory %s: %w", dir, err)
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), g.cfg.Suffix) || expected[path] {
+				continue
+			}
+
+			generated, err := isGeneratedFile(path)
+			if err != nil {
+				return fmt.Errorf("error reading file %s: %w", path, err)
+			}
+
+			if generated {
+				expected[path] = true
+				errs = append(errs, fmt.Errorf("%s: %w, no service generates it anymore", path, ErrStale))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// closeName returns the name of the generated method closing the client's connection:
+// Close, unless methods already has a Close, then CloseConn, CloseConn2 and so on.
+func closeName(methods []Method) string {
+	taken := func(name string) bool {
+		return slices.ContainsFunc(methods, func(method Method) bool { return method.Name == name })
+	}
+
+	name := "Close"
+	for i := 1; taken(name); i++ {
+		name = "CloseConn"
+		if i > 1 {
+			name += strconv.Itoa(i)
+		}
+	}
+
+	return name
+}
+
+// writeManifest writes serviceDatas to path as indented JSON.
+func writeManifest(path string, serviceDatas []ServiceData) error {
+	if serviceDatas == nil {
+		serviceDatas = []ServiceData{}
+	}
+
+	data, err := json.MarshalIndent(serviceDatas, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing manifest %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// sourceFile returns the path of fileName relative to outputDir, falling back to its base name.
+func sourceFile(outputDir, fileName string) string {
+	absDir, err := filepath.Abs(outputDir)
+	if err != nil {
+		return filepath.Base(fileName)
+	}
+
+	rel, err := filepath.Rel(absDir, fileName)
+	if err != nil {
+		return filepath.Base(fileName)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// sameDir reports whether a and b name the same directory.
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+
+	return errA == nil && errB == nil && absA == absB
+}
+
+// inputDir returns the directory named by an -input package pattern such as "./api/...".
+func inputDir(pattern string) string {
+	return filepath.Clean(strings.TrimSuffix(pattern, "..."))
+}
+
+// generatedHeader marks every file written by rpc-gen.
+const generatedHeader = "// Code generated by rpc-gen; DO NOT EDIT."
+
+// isGeneratedFile reports whether the file at path carries generatedHeader.
+func isGeneratedFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = file.Close() }()
+
+	// The header may follow a -header prologue but always precedes the package clause.
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == generatedHeader {
+			return true, nil
+		}
+
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// hasGeneratedHeader reports whether the parsed file carries generatedHeader.
+func hasGeneratedHeader(file *ast.File) bool {
+	for _, group := range file.Comments {
+		if group.Pos() >= file.Package {
+			break
+		}
+
+		for _, comment := range group.List {
+			if comment.Text == generatedHeader {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// deleteGeneratedFiles removes the files in dir ending in -suffix that carry generatedHeader,
+// leaving files written by hand or by other generators, and subdirectories, in place.
+func (g *generator) deleteGeneratedFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), g.cfg.Suffix) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		generated, err := isGeneratedFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading file %s: %w", path, err)
+		}
+
+		if !generated {
+			g.log(slog.LevelInfo, "Keeping file without the rpc-gen header", slog.String("path", path))
+
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error deleting file %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Config configures Generate and Parse. Its fields correspond to the rpc-gen flags
+// of the same name; empty fields take the flag defaults, except that booleans such
+// as Assert default to false.
+type Config struct {
+	Options
+
+	// Input is the package directory or pattern to load, "./..." when empty.
+	Input     string
+	Recursive bool
+	// Files, when set, limits the services to the interfaces declared in these files,
+	// and the packages containing them are loaded instead of Input.
+	Files []string
+	// Tags is a comma-separated list of build tags selecting the files to load.
+	Tags string
+	// Package is the package clause of the generated files, the source package when empty.
+	Package string
+	// StripSuffix is trimmed from interface names to name the generated types, such as
+	// AccountClient for AccountService; StripRPCSuffix also trims it from the RPC name.
+	StripSuffix    string
+	StripRPCSuffix bool
+	// SrcAlias names the source package in code generated outside it, its package name when empty.
+	SrcAlias string
+	// Output is the directory written to, the directory of each interface when empty.
+	Output string
+	All    bool
+	// MethodFilter, when set, limits the generated methods to those whose name it matches.
+	MethodFilter *regexp.Regexp
+	Strict       bool
+	// LooseContext accepts any qualified type, or pointer to one, as the first parameter, not only context.Context.
+	LooseContext bool
+	TypeCheck    bool
+	Clean        bool
+	DryRun       bool
+	SingleFile   bool
+	Verify       bool
+	Manifest     string
+	Stdout       bool
+	Raw          bool
+	// Force overwrites existing files that lack the rpc-gen header.
+	Force  bool
+	Suffix string
+	// FileName is the template naming generated files.
+	FileName string
+	// Template is the path of a custom client template.
+	Template string
+	// Logger receives progress and skipped methods, slog.Default() when nil.
+	Logger *slog.Logger
+}
+
+// DefaultFileName is the default Config.FileName.
+const DefaultFileName = "{{lower .ServiceName}}_{{.Kind}}{{.Suffix}}"
+
+// generator holds the state of one Generate or Parse call.
+type generator struct {
+	cfg Config
+	// diagnostics accumulates every reported validation failure so -strict can fail the run.
+	diagnostics []Diagnostic
+}
+
+// withDefaults fills in the empty fields of c that have a non-zero default.
+func (c Config) withDefaults() Config {
+	if c.Input == "" {
+		c.Input = "./..."
+	}
+
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+
+	if c.Codec == "" {
+		c.Codec = "gob"
+	}
+
+	if c.ClientIfaceSuffix == "" {
+		c.ClientIfaceSuffix = "ClientInterface"
+	}
+
+	if c.Suffix == "" {
+		c.Suffix = "_gen.go"
+	}
+
+	if c.FileName == "" {
+		c.FileName = DefaultFileName
+	}
+
+	// A reconnecting client retries the call that found the connection broken, and
+	// retrying needs a new connection, since a broken rpc.Client never recovers.
+	if c.Reconnect && c.Retries == 0 {
+		c.Retries = 1
+	}
+
+	if c.Retries > 0 {
+		c.Reconnect = true
+	}
+
+	return c
+}
+
+// validate reports the first invalid setting of c.
+func (c Config) validate() error {
+	if c.Network != "tcp" && c.Network != "unix" && c.Network != "http" {
+		return fmt.Errorf("invalid network %q: use tcp, unix or http", c.Network)
+	}
+
+	if c.Network == "http" && c.TLS {
+		return errors.New("the http network does not support TLS")
+	}
+
+	if c.Network == "http" && c.ContextDial {
+		return errors.New("the http network does not support dialing with a context")
+	}
+
+	if c.Network == "http" && c.Codec != "gob" {
+		return fmt.Errorf("the http network only supports the gob codec, not %q", c.Codec)
+	}
+
+	if c.Codec != "gob" && c.Codec != "json" {
+		return fmt.Errorf("invalid codec %q: use gob or json", c.Codec)
+	}
+
+	if c.Package != "" && !token.IsIdentifier(c.Package) {
+		return fmt.Errorf("invalid package name %q", c.Package)
+	}
+
+	if c.SrcAlias != "" && (!token.IsIdentifier(c.SrcAlias) || c.SrcAlias == c.Package) {
+		return fmt.Errorf("invalid source package alias %q", c.SrcAlias)
+	}
+
+	if c.Pool < 0 {
+		return fmt.Errorf("invalid pool size %d: use a non-negative count", c.Pool)
+	}
+
+	if c.Retries < 0 {
+		return fmt.Errorf("invalid retries %d: use a non-negative count", c.Retries)
+	}
+
+	if c.ClientIface && (c.ClientIfaceSuffix == "Client" || !token.IsIdentifier("X"+c.ClientIfaceSuffix)) {
+		return fmt.Errorf("invalid client interface suffix %q", c.ClientIfaceSuffix)
+	}
+
+	if !strings.HasSuffix(c.Suffix, ".go") || strings.HasSuffix(c.Suffix, "_test.go") || strings.ContainsAny(c.Suffix, `/\`) {
+		return fmt.Errorf("invalid suffix %q: use a file name suffix ending in .go, such as _gen.go", c.Suffix)
+	}
+
+	if c.Raw && c.SingleFile {
+		return errors.New("raw output cannot be combined with single-file output, which needs to parse the generated code")
+	}
+
+	if info, err := os.Stat(inputDir(c.Input)); err != nil || !info.IsDir() {
+		return fmt.Errorf("input package directory %q does not exist", c.Input)
+	}
+
+	for _, file := range c.Files {
+		if info, err := os.Stat(file); err != nil || info.IsDir() || !strings.HasSuffix(file, ".go") {
+			return fmt.Errorf("input file %q is not an existing Go file", file)
+		}
+	}
+
+	return nil
+}
+
+// InvalidMethodsError is returned with Config.Strict when interface methods have
+// unsupported signatures.
+type InvalidMethodsError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *InvalidMethodsError) Error() string {
+	lines := make([]string, len(e.Diagnostics))
+	for i, diagnostic := range e.Diagnostics {
+		lines[i] = diagnostic.String()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// TypeCheckError is returned with Config.TypeCheck when the input packages fail to
+// load or type-check.
+type TypeCheckError struct {
+	Errors []packages.Error
+}
+
+func (e *TypeCheckError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, pkgErr := range e.Errors {
+		lines[i] = pkgErr.Error()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Parse loads the packages matched by c.Input and returns the services found in
+// them, without writing anything.
+func Parse(c Config) ([]ServiceData, error) {
+	g := &generator{cfg: c.withDefaults()}
+	if err := g.cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return g.parse()
+}
+
+// Generate writes the client, server and request types files of the services
+// found by Parse, or checks them with c.Verify.
+func Generate(c Config) error {
+	g := &generator{cfg: c.withDefaults()}
+	if err := g.cfg.validate(); err != nil {
+		return err
+	}
+
+	fileNameTemp, err := g.parseFileNameTemplate(g.cfg.FileName)
+	if err != nil {
+		return fmt.Errorf("invalid filename template: %w", err)
+	}
+
+	clientTemp, err := parseClientTemplate(g.cfg.Template, g.cfg.Options)
+	if err != nil {
+		return fmt.Errorf("error parsing client template: %w", err)
+	}
+
+	serverTemp, err := template.New("serverTemplate").Parse(serverTemplate)
+	if err != nil {
+		return fmt.Errorf("error parsing server template: %w", err)
+	}
+
+	typesTemp, err := template.New("typesTemplate").Parse(typesTemplate)
+	if err != nil {
+		return fmt.Errorf("error parsing types template: %w", err)
+	}
+
+	// Type checking needs the code referring to the generated files, so they are
+	// only deleted once the packages are known to be fine.
+	// With Files, the directories also hold the output of services declared elsewhere.
+	clean := g.cfg.Clean && !g.cfg.Stdout && !g.cfg.DryRun && !g.cfg.Verify && len(g.cfg.Files) == 0
+	if clean && !g.cfg.TypeCheck {
+		if err := g.cleanOutput(); err != nil {
+			return err
+		}
+	}
+
+	serviceDatas, err := g.parse()
+	if err != nil {
+		return err
+	}
+
+	if clean && g.cfg.TypeCheck {
+		if err := g.cleanOutput(); err != nil {
+			return err
+		}
+	}
+
+	if err := g.checkCollisions(fileNameTemp, serviceDatas); err != nil {
+		return fmt.Errorf("conflicting output files: %w", err)
+	}
+
+	if g.cfg.Manifest != "" {
+		if err := writeManifest(g.cfg.Manifest, serviceDatas); err != nil {
+			return fmt.Errorf("error writing manifest: %w", err)
+		}
+	}
+
+	if g.cfg.DryRun {
+		if err := g.writeReport(os.Stdout, fileNameTemp, serviceDatas); err != nil {
+			return fmt.Errorf("error writing dry-run report: %w", err)
+		}
+
+		return nil
+	}
+
+	err = g.generateServices(serviceDatas, clientTemp, serverTemp, typesTemp, fileNameTemp)
+	if g.cfg.Verify && g.cfg.Clean && len(g.cfg.Files) == 0 {
+		err = errors.Join(err, g.checkOrphans(fileNameTemp, serviceDatas))
+	}
+
+	return err
+}
+
+// cleanOutput deletes the generated files in the directories of the input packages
+// and the output directory.
+func (g *generator) cleanOutput() error {
+	dirs, err := g.outputDirs()
+	if err != nil {
+		return fmt.Errorf("error listing packages to clean: %w", err)
+	}
+
+	for _, dir := range dirs {
+		if err := g.deleteGeneratedFiles(dir); err != nil {
+			return fmt.Errorf("error deleting generated files: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// inputPattern returns the package pattern of g.cfg.Input, ending in "/..." with Recursive.
+func (g *generator) inputPattern() string {
+	if g.cfg.Recursive && !strings.HasSuffix(g.cfg.Input, "...") {
+		return strings.TrimSuffix(g.cfg.Input, "/") + "/..."
+	}
+
+	return g.cfg.Input
+}
+
+// buildFlags returns the go command flags selecting the files to load.
+func (g *generator) buildFlags() []string {
+	if g.cfg.Tags == "" {
+		return nil
+	}
+
+	return []string{"-tags=" + g.cfg.Tags}
+}
+
+// outputDirs returns the directories of the packages matched by g.cfg.Input, and
+// g.cfg.Output when it exists, which are the directories -clean deletes files in.
+func (g *generator) outputDirs() ([]string, error) {
+	packagesCfg := &packages.Config{
+		Mode:       packages.NeedName | packages.NeedFiles,
+		BuildFlags: g.buildFlags(),
+	}
+
+	pkgs, err := packages.Load(packagesCfg, g.inputPattern())
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, pkg := range pkgs {
+		// A package whose files are all excluded by build constraints still has
+		// generated files from other builds.
+		for _, file := range slices.Concat(pkg.GoFiles, pkg.IgnoredFiles) {
+			if dir := filepath.Dir(file); !slices.Contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	// An output directory that does not exist yet is created when writing.
+	if _, err := os.Stat(g.cfg.Output); g.cfg.Output != "" && !errors.Is(err, os.ErrNotExist) {
+		dir, err := filepath.Abs(g.cfg.Output)
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs, nil
+}
+
+// parse loads the packages matched by g.cfg.Input and extracts their services.
+func (g *generator) parse() ([]ServiceData, error) {
+	patterns := []string{g.inputPattern()}
+
+	// files holds the absolute paths of g.cfg.Files, whose packages are loaded instead.
+	var files []string
+	if len(g.cfg.Files) > 0 {
+		patterns = nil
+
+		for _, file := range g.cfg.Files {
+			path, err := filepath.Abs(file)
+			if err != nil {
+				return nil, fmt.Errorf("error resolving file %s: %w", file, err)
+			}
+
+			files = append(files, path)
+			patterns = append(patterns, "file="+path)
+		}
+	}
+
+	packagesCfg := &packages.Config{
+		Mode: packages.NeedName |
+			packages.NeedFiles |
+			packages.NeedTypes |
+			packages.NeedTypesInfo |
+			packages.NeedSyntax |
+			packages.NeedImports |
+			packages.NeedDeps,
+	}
+
+	// Files are included by their build constraints for GOOS, GOARCH and Tags.
+	packagesCfg.BuildFlags = g.buildFlags()
+
+	pkgs, err := packages.Load(packagesCfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		serviceDatas []ServiceData
+		extractErr   error
+	)
+
+	// services indexes serviceDatas by package path and service name.
+	services := make(map[string]int)
+
+	// loadErrs collects the errors failing the run with g.cfg.TypeCheck.
+	var loadErrs []packages.Error
+
+	for _, pkg := range pkgs {
+		// Type errors, such as references to generated code deleted by -clean, leave the
+		// interfaces usable; methods using undefined types are rejected by extractMethods.
+		if len(pkg.Errors) > 0 {
+			for _, pkgErr := range pkg.Errors {
+				g.log(slog.LevelWarn, "Package load error", slog.String("error", pkgErr.Error()))
+
+				if g.cfg.TypeCheck && !g.inGeneratedFile(pkgErr) {
+					loadErrs = append(loadErrs, pkgErr)
+				}
+			}
+
+			if pkg.TypesInfo == nil || slices.ContainsFunc(pkg.Errors, func(pkgErr packages.Error) bool { return pkgErr.Kind != packages.TypeError }) {
+				continue
+			}
+		}
+
+		g.log(slog.LevelInfo, "Processing package", slog.String("package", pkg.PkgPath))
+
+		interfaces := collectInterfaces(pkg.Syntax)
+
+		for _, file := range pkg.Syntax {
+			fileName := pkg.Fset.Position(file.Pos()).Filename
+
+			if files != nil && !slices.Contains(files, fileName) {
+				continue
+			}
+
+			// Output of earlier runs, kept when not cleaning or when verifying, declares no services.
+			if strings.HasSuffix(fileName, g.cfg.Suffix) && hasGeneratedHeader(file) {
+				g.log(slog.LevelInfo, "Skipping generated file", slog.String("file", fileName))
+
+				continue
+			}
+
+			g.log(slog.LevelInfo, "Processing file", slog.String("file", fileName))
+
+			ast.Inspect(file, func(n ast.Node) bool {
+				if extractErr != nil {
+					return false
+				}
+
+				genDecl, ok := n.(*ast.GenDecl)
+				if !ok || genDecl.Tok != token.TYPE {
+					return true
+				}
+
+				for _, spec := range genDecl.Specs {
+					typeSpec := spec.(*ast.TypeSpec)
+
+					interfaceType, ok := typeSpec.Type.(*ast.InterfaceType)
+					if !ok {
+						continue
+					}
+
+					interfaceName := typeSpec.Name.Name
+					serviceName := interfaceName
+					pos := pkg.Fset.Position(typeSpec.Pos())
+					g.log(slog.LevelInfo, "Found interface", slog.String("name", serviceName),
+						slog.String("info", fmt.Sprintf("%s:%d:%d", fileName, pos.Line, pos.Column)))
+
+					// A lone "type X interface" declaration carries its doc comment on the GenDecl.
+					doc := typeSpec.Doc
+					if doc == nil && !genDecl.Lparen.IsValid() {
+						doc = genDecl.Doc
+					}
+
+					directives := parseDirectives(doc)
+					if _, ok := directives[ignoreDirective]; ok {
+						g.log(slog.LevelInfo, "Skipping interface marked with "+directivePrefix+ignoreDirective,
+							slog.String("name", serviceName))
+
+						continue
+					}
+
+					if _, ok := directives[serviceDirective]; !ok && !g.cfg.All {
+						g.log(slog.LevelInfo, "Skipping interface without "+directivePrefix+serviceDirective+" marker",
+							slog.String("name", serviceName))
+
+						continue
+					}
+
+					// Interfaces marked with the same //rpc-gen:service=Name make up one service.
+					if name := directives[serviceDirective]; name != "" {
+						if !token.IsIdentifier(name) {
+							extractErr = fmt.Errorf("%s:%d: %s has an invalid %s%s directive %q",
+								fileName, pos.Line, interfaceName, directivePrefix, serviceDirective, name)
+
+							return false
+						}
+
+						serviceName = name
+					}
+
+					// StripSuffix shortens the names of the generated types, and of the RPC
+					// service only with StripRPCSuffix.
+					rpcName := serviceName
+					if trimmed, ok := strings.CutSuffix(serviceName, g.cfg.StripSuffix); ok && trimmed != "" && g.cfg.StripSuffix != "" && directives[serviceDirective] == "" {
+						serviceName = trimmed
+						if g.cfg.StripRPCSuffix {
+							rpcName = trimmed
+						}
+					}
+
+					// The generated client and server are not generic, so they cannot implement
+					// an interface with type parameters.
+					if typeSpec.TypeParams != nil {
+						g.log(slog.LevelWarn, "Skipping generic interface", slog.String("name", serviceName),
+							slog.String("info", fmt.Sprintf("%s:%d:%d", fileName, pos.Line, pos.Column)))
+
+						continue
+					}
+
+					// Extract methods from interface
+					outputDir := g.cfg.Output
+					if outputDir == "" {
+						outputDir = filepath.Dir(fileName)
+					}
+
+					packageName := pkg.Name
+					if g.cfg.Package != "" {
+						packageName = g.cfg.Package
+					}
+
+					imports := collectImports(pkg.Types, pkg.TypesInfo, interfaceType, interfaces)
+
+					// Code generated outside the source package refers back to it through an import.
+					var qualifier string
+					if packageName != pkg.Name || !sameDir(outputDir, filepath.Dir(fileName)) {
+						srcImport := Import{Path: pkg.PkgPath, PackageName: pkg.Name}
+						if g.cfg.SrcAlias != "" && g.cfg.SrcAlias != pkg.Name {
+							srcImport.Name = g.cfg.SrcAlias
+						}
+
+						qualifier = srcImport.ident()
+						if slices.ContainsFunc(imports, func(imp Import) bool { return imp.ident() == qualifier }) {
+							extractErr = fmt.Errorf("%s:%d: %s refers to another package named %s; set a different source package alias",
+								fileName, pos.Line, interfaceName, qualifier)
+
+							return false
+						}
+
+						imports = append(imports, srcImport)
+					}
+
+					// net/rpc splits "Service.Method" at the last dot, so calls always carry
+					// a service name; it may be changed but not dropped.
+					if _, ok := directives[prefixDirective]; ok {
+						extractErr = fmt.Errorf("%s:%d: %s: net/rpc requires Service.Method names, so %s%s is not supported; use %s%s to change the service name",
+							fileName, pos.Line, interfaceName, directivePrefix, prefixDirective, directivePrefix, nameDirective)
+
+						return false
+					}
+
+					if name, ok := directives[nameDirective]; ok {
+						if !validRPCName(name) {
+							extractErr = fmt.Errorf("%s:%d: %s has an invalid %s%s directive %q",
+								fileName, pos.Line, interfaceName, directivePrefix, nameDirective, name)
+
+							return false
+						}
+
+						rpcName = name
+					}
+
+					serviceType := interfaceName
+					if qualifier != "" {
+						serviceType = qualifier + "." + interfaceName
+					}
+
+					skipped := len(g.diagnostics)
+					methods, err := g.extractMethods(pkg.Fset, pkg.Types, pkg.TypesInfo, fileName, serviceName, qualifier, imports, interfaceType, interfaces)
+					if err != nil {
+						extractErr = fmt.Errorf("error extracting methods: %w", err)
+
+						return false
+					}
+					g.log(slog.LevelInfo, "Extracted methods", slog.String("service", serviceName), slog.Int("methods", len(methods)))
+
+					options := g.cfg.Options
+					// A client missing filtered out or invalid methods does not implement the interface.
+					if g.cfg.MethodFilter != nil || len(g.diagnostics) > skipped {
+						options.Assert = false
+					}
+
+					serviceData := ServiceData{
+						Options:     options,
+						FilePath:    fileName,
+						SourceFile:  sourceFile(outputDir, fileName),
+						OutputDir:   outputDir,
+						PackageName: packageName,
+						ServiceName: serviceName,
+						RPCName:     rpcName,
+						ServiceDoc:  extractDoc(doc),
+						ServiceType: serviceType,
+						Imports:     imports,
+						Methods:     methods,
+						CloseName:   closeName(methods),
+						GobTypes:    collectGobTypes(methods),
+					}
+
+					key := pkg.PkgPath + "." + serviceName
+					i, ok := services[key]
+					if !ok {
+						// Interfaces embedding others may declare a method twice.
+						if err := checkDuplicateMethods(serviceName, methods); err != nil {
+							extractErr = fmt.Errorf("%s:%d: %w", fileName, pos.Line, err)
+
+							return false
+						}
+
+						services[key] = len(serviceDatas)
+						serviceDatas = append(serviceDatas, serviceData)
+
+						continue
+					}
+
+					if err := mergeService(&serviceDatas[i], serviceData); err != nil {
+						extractErr = fmt.Errorf("%s:%d: %w", fileName, pos.Line, err)
+
+						return false
+					}
+				}
+
+				return true
+			})
+
+			if extractErr != nil {
+				return nil, extractErr
+			}
+		}
+	}
+
+	if len(loadErrs) > 0 {
+		return nil, &TypeCheckError{Errors: loadErrs}
+	}
+
+	if g.cfg.Strict && len(g.diagnostics) > 0 {
+		return nil, &InvalidMethodsError{Diagnostics: g.diagnostics}
+	}
+
+	declareRPCErrors(serviceDatas)
+
+	return serviceDatas, nil
+}
+
+// declareRPCErrors picks, in each output package, the service named first among those
+// with TypedErrors to declare RPCError.
+func declareRPCErrors(serviceDatas []ServiceData) {
+	type outputPackage struct{ dir, name string }
+
+	owners := make(map[outputPackage]int)
+	for i, serviceData := range serviceDatas {
+		if !serviceData.TypedErrors {
+			continue
+		}
+
+		key := outputPackage{filepath.Clean(serviceData.OutputDir), serviceData.PackageName}
+		if owner, ok := owners[key]; !ok || serviceData.ServiceName < serviceDatas[owner].ServiceName {
+			owners[key] = i
+		}
+	}
+
+	for _, i := range owners {
+		serviceDatas[i].DeclareRPCError = true
+	}
+}
+
+// inGeneratedFile reports whether pkgErr is located in a file written by rpc-gen,
+// whose errors go away once it is generated again.
+func (g *generator) inGeneratedFile(pkgErr packages.Error) bool {
+	path, _, _ := strings.Cut(pkgErr.Pos, ":")
+	if path == "" || !strings.HasSuffix(path, g.cfg.Suffix) {
+		return false
+	}
+
+	generated, err := isGeneratedFile(path)
+
+	return err == nil && generated
+}
+
+// mergeService adds the methods of src, another interface of the same service, to dst.
+// The generated code then refers to the interfaces through one embedding them all.
+func mergeService(dst *ServiceData, src ServiceData) error {
+	if src.RPCName != src.ServiceName {
+		if dst.RPCName != dst.ServiceName && dst.RPCName != src.RPCName {
+			return fmt.Errorf("service %s is registered as both %s and %s", dst.ServiceName, dst.RPCName, src.RPCName)
+		}
+
+		dst.RPCName = src.RPCName
+	}
+
+	members := []string{dst.ServiceType}
+	if embedded, ok := strings.CutPrefix(dst.ServiceType, "interface {\n"); ok {
+		members = strings.Split(strings.TrimSuffix(embedded, "\n}"), "\n")
+	}
+
+	members = append(members, src.ServiceType)
+	dst.ServiceType = "interface {\n" + strings.Join(members, "\n") + "\n}"
+
+	for _, imp := range src.Imports {
+		if !slices.ContainsFunc(dst.Imports, func(i Import) bool { return i.Path == imp.Path }) {
+			dst.Imports = append(dst.Imports, imp)
+		}
+	}
+
+	if !src.Assert {
+		dst.Assert = false
+	}
+
+	if len(dst.ServiceDoc) == 0 {
+		dst.ServiceDoc = src.ServiceDoc
+	}
+
+	dst.Methods = append(dst.Methods, src.Methods...)
+	if err := checkDuplicateMethods(dst.ServiceName, dst.Methods); err != nil {
+		return err
+	}
+
+	dst.CloseName = closeName(dst.Methods)
+	dst.GobTypes = collectGobTypes(dst.Methods)
+
+	return nil
+}
+
+// checkDuplicateMethods fails when two of methods share a name, which the generated
+// client and server could not both declare.
+func checkDuplicateMethods(serviceName string, methods []Method) error {
+	seen := make(map[string]Method, len(methods))
+	for _, method := range methods {
+		if first, ok := seen[method.Name]; ok {
+			return fmt.Errorf("service %s declares method %s twice, at %s and %s",
+				serviceName, method.Name, first.Source, method.Source)
+		}
+
+		seen[method.Name] = method
+	}
+
+	return nil
+}
+
+// writeReport describes the services and methods that would be generated, for -dry-run.
+func (g *generator) writeReport(w io.Writer, fileNameTemp *template.Template, serviceDatas []ServiceData) error {
+	for _, serviceData := range serviceDatas {
+		fmt.Fprintf(w, "%s (%s)\n", serviceData.ServiceName, serviceData.FilePath)
+		if serviceData.RPCName != serviceData.ServiceName {
+			fmt.Fprintf(w, "  registered as %s\n", serviceData.RPCName)
+		}
+
+		for _, kind := range outputKinds(serviceData) {
+			path, err := g.outputPath(fileNameTemp, serviceData, kind)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(w, "  %s: %s\n", kind, path)
+		}
+
+		for _, method := range serviceData.Methods {
+			response := "error"
+			if method.HasResponse && method.ResponsePointer {
+				response = "(*" + method.ResponseType + ", error)"
+			} else if method.HasResponse {
+				response = "(" + method.ResponseType + ", error)"
+			}
+
+			fmt.Fprintf(w, "  %s(%s) %s\n", method.Name, method.RequestType, response)
+		}
+	}
+
+	return nil
+}
+
+// generateService writes the client, server and, when needed, request types files for one service.
+func (g *generator) generateService(serviceData ServiceData, clientTemp, serverTemp, typesTemp, fileNameTemp *template.Template) error {
+	g.log(slog.LevelInfo, "Generating client for service", slog.String("service", serviceData.ServiceName))
+
+	if err := g.writeCode(g.generateClientCode, clientTemp, fileNameTemp, serviceData, "client"); err != nil {
+		return fmt.Errorf("error generating client code for %s: %w", serviceData.ServiceName, err)
+	}
+
+	g.log(slog.LevelInfo, "Client code generated successfully for service", slog.String("service", serviceData.ServiceName))
+
+	g.log(slog.LevelInfo, "Generating server for service", slog.String("service", serviceData.ServiceName))
+
+	if err := g.writeCode(g.generateServerCode, serverTemp, fileNameTemp, serviceData, "server"); err != nil {
+		return fmt.Errorf("error generating server code for %s: %w", serviceData.ServiceName, err)
+	}
+
+	g.log(slog.LevelInfo, "Server code generated successfully for service", slog.String("service", serviceData.ServiceName))
+
+	if !slices.Contains(outputKinds(serviceData), "types") {
+		return nil
+	}
+
+	g.log(slog.LevelInfo, "Generating request types for service", slog.String("service", serviceData.ServiceName))
+
+	if err := g.writeCode(g.generateTypesCode, typesTemp, fileNameTemp, serviceData, "types"); err != nil {
+		return fmt.Errorf("error generating request types for %s: %w", serviceData.ServiceName, err)
+	}
+
+	return nil
+}
+
+// generateServices runs generateService for every service on a pool of GOMAXPROCS workers
+// and returns all failures joined together. With -single-file the services sharing an
+// output directory are generated together by generateMerged. With -stdout the work is
+// done one at a time so the output is not interleaved.
+func (g *generator) generateServices(serviceDatas []ServiceData, clientTemp, serverTemp, typesTemp, fileNameTemp *template.Template) error {
+	var tasks []func() error
+	if g.cfg.SingleFile {
+		groups := make(map[string][]ServiceData)
+		var dirs []string
+		for _, serviceData := range serviceDatas {
+			dir := filepath.Clean(serviceData.OutputDir)
+			if _, ok := groups[dir]; !ok {
+				dirs = append(dirs, dir)
+			}
+
+			groups[dir] = append(groups[dir], serviceData)
+		}
+
+		for _, dir := range dirs {
+			tasks = append(tasks, func() error {
+				return g.generateMerged(groups[dir], clientTemp, serverTemp, typesTemp, fileNameTemp)
+			})
+		}
+	} else {
+		for _, serviceData := range serviceDatas {
+			tasks = append(tasks, func() error {
+				return g.generateService(serviceData, clientTemp, serverTemp, typesTemp, fileNameTemp)
+			})
+		}
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if g.cfg.Stdout {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	errs := make([]error, len(tasks))
+
+	var wg sync.WaitGroup
+	for range min(workers, len(tasks)) {
+		wg.Go(func() {
+			for i := range jobs {
+				errs[i] = tasks[i]()
+			}
+		})
+	}
+
+	for i := range tasks {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// generateMerged writes one file per kind holding the code of every service in
+// serviceDatas, which share an output directory. Each struct is registered with gob
+// by the first service using it only.
+func (g *generator) generateMerged(serviceDatas []ServiceData, clientTemp, serverTemp, typesTemp, fileNameTemp *template.Template) error {
+	registered := make(map[string]bool)
+	for i, serviceData := range serviceDatas {
+		var gobTypes []string
+		for _, gobType := range serviceData.GobTypes {
+			if !registered[gobType] {
+				registered[gobType] = true
+				gobTypes = append(gobTypes, gobType)
+			}
+		}
+
+		serviceDatas[i].GobTypes = gobTypes
+	}
+
+	generators := []struct {
+		kind     string
+		generate func(io.Writer, *template.Template, ServiceData) error
+		temp     *template.Template
+	}{
+		{"client", g.generateClientCode, clientTemp},
+		{"server", g.generateServerCode, serverTemp},
+		{"types", g.generateTypesCode, typesTemp},
+	}
+
+	for _, generator := range generators {
+		var sources [][]byte
+		for _, serviceData := range serviceDatas {
+			if !slices.Contains(outputKinds(serviceData), generator.kind) {
+				continue
+			}
+
+			g.log(slog.LevelInfo, "Generating "+generator.kind+" for service", slog.String("service", serviceData.ServiceName))
+
+			buf := new(bytes.Buffer)
+			if err := generator.generate(buf, generator.temp, serviceData); err != nil {
+				return fmt.Errorf("error generating %s code for %s: %w", generator.kind, serviceData.ServiceName, err)
+			}
+
+			sources = append(sources, buf.Bytes())
+		}
+
+		if len(sources) == 0 {
+			continue
+		}
+
+		merged, err := mergeSources(sources)
+		if err != nil {
+			return fmt.Errorf("error merging %s code in %s: %w", generator.kind, serviceDatas[0].OutputDir, err)
+		}
+
+		w, err := g.openOutput(fileNameTemp, serviceDatas[0], generator.kind)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(merged); err != nil {
+			_ = w.Close()
+			return fmt.Errorf("error writing generated code: %w", err)
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeSources combines generated files of one package into a single file, keeping the
+// header comments of each, the union of their imports and all their declarations.
+func mergeSources(sources [][]byte) ([]byte, error) {
+	var (
+		packageName string
+		header      []string
+		importSpecs []string
+		decls       bytes.Buffer
+	)
+
+	fset := token.NewFileSet()
+	for _, src := range sources {
+		file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+
+		tokenFile := fset.File(file.Pos())
+		text := func(from, to token.Pos) string {
+			return string(src[tokenFile.Offset(from):tokenFile.Offset(to)])
+		}
+
+		packageName = file.Name.Name
+
+		// The comments of the first file are kept as they are; later files only add
+		// the lines it lacks, such as their Source line.
+		if len(header) == 0 {
+			header = append(header, strings.TrimSpace(string(src[:tokenFile.Offset(file.Package)])))
+		} else {
+			for _, comment := range file.Comments {
+				if comment.Pos() > file.Package {
+					break
+				}
+
+				for _, line := range comment.List {
+					if !slices.ContainsFunc(header, func(h string) bool { return slices.Contains(strings.Split(h, "\n"), line.Text) }) {
+						header = append(header, line.Text)
+					}
+				}
+			}
+		}
+
+		for _, spec := range file.Imports {
+			if importSpec := text(spec.Pos(), spec.End()); !slices.Contains(importSpecs, importSpec) {
+				importSpecs = append(importSpecs, importSpec)
+			}
+		}
+
+		for _, decl := range file.Decls {
+			start := decl.Pos()
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				if decl.Tok == token.IMPORT {
+					continue
+				}
+
+				if decl.Doc != nil {
+					start = decl.Doc.Pos()
+				}
+			case *ast.FuncDecl:
+				if decl.Doc != nil {
+					start = decl.Doc.Pos()
+				}
+			}
+
+			decls.WriteString(text(start, decl.End()))
+			decls.WriteString("\n\n")
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s\n\npackage %s\n\nimport (\n", strings.Join(header, "\n"), packageName)
+	for _, importSpec := range importSpecs {
+		fmt.Fprintf(buf, "%s\n", importSpec)
+	}
+	fmt.Fprintf(buf, ")\n\n")
+	buf.Write(decls.Bytes())
+
+	return format.Source(buf.Bytes())
+}
+
+// writeCode generates the kind file of serviceData with generate and writes it out.
+func (g *generator) writeCode(generate func(io.Writer, *template.Template, ServiceData) error, temp, fileNameTemp *template.Template, serviceData ServiceData, kind string) error {
+	// The code is generated before the output is opened, so a failing template or
+	// code that does not format leaves the existing file untouched.
+	buf := new(bytes.Buffer)
+	if err := generate(buf, temp, serviceData); err != nil {
+		return err
+	}
+
+	w, err := g.openOutput(fileNameTemp, serviceData, kind)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("error writing generated code: %w", err)
+	}
+
+	return w.Close()
+}
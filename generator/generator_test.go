@@ -0,0 +1,3944 @@
+package generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// service is a source file declaring a two-method service.
+const service = `package m
+
+import "context"
+
+type Args struct{ A, B int }
+
+type Reply struct{ Sum int }
+
+//rpc-gen:service
+type Arith interface {
+	Add(ctx context.Context, args Args) (*Reply, error)
+	Reset(ctx context.Context) error
+}
+`
+
+// writeModule creates a temporary module holding files and changes into it.
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	files["go.mod"] = "module example.com/m\n\ngo 1.25\n"
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Chdir(dir)
+
+	return dir
+}
+
+// generate runs Generate with c, discarding its log.
+func generate(c Config) error {
+	c.Logger = slog.New(slog.DiscardHandler)
+
+	return Generate(c)
+}
+
+// parse runs Parse with c, discarding its log.
+func parse(c Config) ([]ServiceData, error) {
+	c.Logger = slog.New(slog.DiscardHandler)
+
+	return Parse(c)
+}
+
+// goCommand runs the go command in dir and fails the test with its output on error.
+func goCommand(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestGenerate(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	if err := generate(Config{Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := readFile(t, filepath.Join(dir, "arith_client_gen.go"))
+	for _, want := range []string{"var _ Arith = (*ArithClient)(nil)", `"Arith.Add"`, `"Arith.Reset"`} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "arith_server_gen.go")); err != nil {
+		t.Error(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateOutputDir(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	if err := generate(Config{Output: "rpc/arith", Package: "arith"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "rpc", "arith", "arith_client_gen.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestValidateMethodSignatureNilFuncType(t *testing.T) {
+	g := &generator{cfg: Config{Logger: slog.New(slog.DiscardHandler)}}
+	method := &ast.Field{Names: []*ast.Ident{ast.NewIdent("Add")}}
+
+	if g.validateMethodSignature(token.NewFileSet(), nil, "arith.go", "Arith", "Add", method, nil) {
+		t.Fatal("method without a function type is valid")
+	}
+
+	if len(g.diagnostics) != 1 || g.diagnostics[0].Reason != "is not a valid function" {
+		t.Fatalf("diagnostics = %v", g.diagnostics)
+	}
+}
+
+func TestGenerateEmbeddedInterface(t *testing.T) {
+	dir := writeModule(t, map[string]string{"store.go": `package m
+
+import "context"
+
+type Key struct{ Name string }
+
+type Value struct{ Data []byte }
+
+type Reader interface {
+	Get(ctx context.Context, key Key) (*Value, error)
+}
+
+//rpc-gen:service
+type Store interface {
+	Reader
+	Put(ctx context.Context, value Value) error
+}
+`})
+
+	if err := generate(Config{Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := readFile(t, filepath.Join(dir, "store_client_gen.go"))
+	for _, want := range []string{"func (c *StoreClient) Get(", "func (c *StoreClient) Put("} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateInvalidMethod(t *testing.T) {
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Reset(n int) error", 1)
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	// The client lacks Reset, so it cannot be asserted to implement Arith.
+	if err := generate(Config{Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := readFile(t, filepath.Join(dir, "arith_client_gen.go"))
+	if strings.Contains(client, "Reset") || strings.Contains(client, "var _ Arith") {
+		t.Error("client declares the invalid method or asserts the interface")
+	}
+
+	goCommand(t, dir, "vet", "./...")
+
+	var invalidErr *InvalidMethodsError
+	if err := generate(Config{Strict: true}); !errors.As(err, &invalidErr) {
+		t.Fatalf("strict generation returned %v, want an *InvalidMethodsError", err)
+	}
+
+	if len(invalidErr.Diagnostics) != 1 || invalidErr.Diagnostics[0].Method != "Reset" {
+		t.Errorf("diagnostics = %v", invalidErr.Diagnostics)
+	}
+}
+
+func TestGenerateDuplicateMethods(t *testing.T) {
+	writeModule(t, map[string]string{"store.go": `package m
+
+import "context"
+
+type Key struct{ Name string }
+
+type Reader interface {
+	Get(ctx context.Context, key Key) error
+}
+
+//rpc-gen:service
+type Store interface {
+	Reader
+	Get(ctx context.Context, key Key) error
+}
+`})
+
+	if err := generate(Config{}); err == nil || !strings.Contains(err.Error(), "Get") {
+		t.Fatalf("generation returned %v, want an error naming Get", err)
+	}
+}
+
+func TestGenerateMethodFilter(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	if err := generate(Config{MethodFilter: regexp.MustCompile("^Add$"), Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := readFile(t, filepath.Join(dir, "arith_client_gen.go"))
+	if strings.Contains(client, "Reset") || strings.Contains(client, "var _ Arith") {
+		t.Error("client declares the filtered out method or asserts the interface")
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateLooseContext(t *testing.T) {
+	dir := writeModule(t, map[string]string{"fixture.go": `package m
+
+import "testing"
+
+type Fixture struct{ Name string }
+
+//rpc-gen:service
+type Fixtures interface {
+	Setup(t *testing.T, fixture Fixture) error
+}
+`})
+
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "fixtures_client_gen.go")
+	if strings.Contains(readFile(t, path), "Setup(") {
+		t.Fatal("method taking *testing.T is generated without LooseContext")
+	}
+
+	if err := generate(Config{LooseContext: true, Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(readFile(t, path), "Setup(_ *testing.T, fixture Fixture) error") {
+		t.Error("client does not declare Setup taking *testing.T")
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateStripSuffix(t *testing.T) {
+	src := strings.ReplaceAll(service, "Arith interface", "ArithService interface")
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	if err := generate(Config{StripSuffix: "Service"}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := readFile(t, filepath.Join(dir, "arith_client_gen.go"))
+	if !strings.Contains(client, "type ArithClient struct") || !strings.Contains(client, `"ArithService.Add"`) {
+		t.Error("client is not named ArithClient calling the ArithService service")
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateVerify(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generate(Config{Verify: true}); err != nil {
+		t.Fatalf("verifying fresh files: %v", err)
+	}
+
+	path := filepath.Join(dir, "arith_client_gen.go")
+	before := readFile(t, path)
+
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Reset(ctx context.Context) error\n\tClear(ctx context.Context) error", 1)
+	if err := os.WriteFile(filepath.Join(dir, "arith.go"), []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generate(Config{Verify: true}); !errors.Is(err, ErrStale) {
+		t.Fatalf("verifying stale files returned %v, want ErrStale", err)
+	}
+
+	if readFile(t, path) != before {
+		t.Error("verifying rewrote the stale file")
+	}
+}
+
+func TestGenerateForce(t *testing.T) {
+	const handWritten = "package m\n\n// ArithClient is written by hand.\ntype ArithClient struct{}\n"
+
+	dir := writeModule(t, map[string]string{"arith.go": service, "arith_client_gen.go": handWritten})
+	path := filepath.Join(dir, "arith_client_gen.go")
+
+	if err := generate(Config{}); err == nil || !strings.Contains(err.Error(), "use -force") {
+		t.Fatalf("generation returned %v, want an error asking for -force", err)
+	}
+
+	if readFile(t, path) != handWritten {
+		t.Fatal("generation overwrote the hand-written file")
+	}
+
+	if err := generate(Config{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if readFile(t, path) == handWritten {
+		t.Fatal("generation with Force kept the hand-written file")
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateTemplateError(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service, "bad.tmpl": "package {{.PackageName}}\n\n{{.Missing}}\n"})
+
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "arith_client_gen.go")
+	before := readFile(t, path)
+
+	if err := generate(Config{Template: "bad.tmpl"}); err == nil {
+		t.Fatal("generation with a failing template succeeded")
+	}
+
+	if readFile(t, path) != before {
+		t.Error("a failing template replaced the generated file")
+	}
+}
+
+func TestGenerateTags(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": "//go:build special\n\n" + service})
+
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "arith_client_gen.go")
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("service in a file excluded by its build constraint is generated")
+	}
+
+	if err := generate(Config{Tags: "special"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// roundTrip generates src with c and the in-memory pipe client, then runs test,
+// the body of a test file exercising it, with go test in the module.
+func roundTrip(t *testing.T, c Config, src, test string) {
+	t.Helper()
+
+	dir := writeModule(t, map[string]string{"service.go": src, "service_test.go": test})
+
+	c.Pipe = true
+	if err := generate(c); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "test", "./...")
+}
+
+// arithService declares a service with an implementation for round trips.
+const arithService = `package m
+
+import (
+	"context"
+	"errors"
+)
+
+type Args struct{ A, B int }
+
+type Reply struct{ Sum int }
+
+//rpc-gen:service
+type Arith interface {
+	Add(ctx context.Context, args Args) (*Reply, error)
+	Sum(ctx context.Context, values ...int) (int, error)
+	Fail(ctx context.Context) error
+}
+
+type arith struct{}
+
+func (arith) Add(_ context.Context, args Args) (*Reply, error) {
+	return &Reply{Sum: args.A + args.B}, nil
+}
+
+func (arith) Sum(_ context.Context, values ...int) (int, error) {
+	sum := 0
+	for _, value := range values {
+		sum += value
+	}
+
+	return sum, nil
+}
+
+func (arith) Fail(context.Context) error {
+	return errors.New("failed")
+}
+`
+
+func TestPipeClientRoundTrip(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"testing"
+)
+
+func TestArith(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	reply, err := client.Add(ctx, Args{A: 1, B: 2})
+	if err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+
+	if sum, err := client.Sum(ctx, 1, 2, 3); err != nil || sum != 6 {
+		t.Errorf("Sum = %d, %v", sum, err)
+	}
+
+	var serverErr rpc.ServerError
+	if err := client.Fail(ctx); !errors.As(err, &serverErr) || serverErr != "failed" {
+		t.Errorf("Fail = %v", err)
+	}
+
+	call := <-client.AddAsync(Args{A: 2, B: 3}).Done
+	if call.Error != nil || call.Reply.(*Reply).Sum != 5 {
+		t.Errorf("AddAsync = %v, %v", call.Reply, call.Error)
+	}
+}
+`
+
+	for _, codec := range []string{"gob", "json"} {
+		t.Run(codec, func(t *testing.T) {
+			roundTrip(t, Config{Options: Options{Codec: codec, Async: true, Assert: true}}, arithService, test)
+		})
+	}
+}
+
+func TestClientDialOptions(t *testing.T) {
+	const test = `package m
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestDialOptions(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The first byte of a TLS handshake is 0x16; plain rpc connections are served.
+	handshakes := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			first := make([]byte, 1)
+			if _, err := conn.Read(first); err != nil || first[0] == 0x16 {
+				handshakes <- err == nil
+				conn.Close()
+				continue
+			}
+
+			go server.ServeConn(&prefixConn{Conn: conn, prefix: first})
+		}
+	}()
+
+	var netErr net.Error
+	if _, err := NewArithClient(l.Addr().String(), WithArithTimeout(time.Nanosecond)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("dialing with WithArithTimeout(time.Nanosecond) = %v, want a timeout", err)
+	}
+
+	if _, err := NewArithClient(l.Addr().String(), WithArithTLSConfig(&tls.Config{ServerName: "arith"})); err == nil {
+		t.Error("dialing a plain server with WithArithTLSConfig succeeded")
+	}
+
+	if !<-handshakes {
+		t.Error("WithArithTLSConfig did not start a TLS handshake")
+	}
+
+	client, err := NewArithClient(l.Addr().String(), WithArithTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if sum, err := client.Sum(t.Context(), 1, 2); err != nil || sum != 3 {
+		t.Errorf("Sum = %d, %v", sum, err)
+	}
+}
+
+// prefixConn replays prefix before reading from Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+
+	return c.Conn.Read(p)
+}
+`
+
+	roundTrip(t, Config{}, arithService, test)
+}
+
+func TestGenerateCleanScope(t *testing.T) {
+	sub := strings.ReplaceAll(strings.Replace(service, "package m", "package sub", 1), "Arith", "Sub")
+	dir := writeModule(t, map[string]string{"a/arith.go": strings.Replace(service, "package m", "package a", 1), "a/sub/sub.go": sub})
+
+	if err := generate(Config{Input: "./a", Recursive: true, Clean: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "a", "sub", "sub_client_gen.go")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The subpackage is outside a non-recursive run, so its files are left alone.
+	if err := generate(Config{Input: "./a", Clean: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("non-recursive clean deleted the subpackage's files: %v", err)
+	}
+
+	if err := generate(Config{Input: "./a", Clean: true, Verify: true}); err != nil {
+		t.Fatalf("verifying with clean reports the subpackage's files: %v", err)
+	}
+
+	// A service removed from a loaded package leaves no orphans.
+	if err := os.WriteFile(filepath.Join(dir, "a", "arith.go"), []byte("package a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generate(Config{Input: "./a", Clean: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a", "arith_client_gen.go")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("clean kept the removed service's client: %v", err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateForeignEmbeddedInterface(t *testing.T) {
+	dir := writeModule(t, map[string]string{"store.go": `package m
+
+import (
+	"context"
+	"fmt"
+)
+
+type Value struct{ Data []byte }
+
+//rpc-gen:service
+type Store interface {
+	fmt.Stringer
+	Put(ctx context.Context, value Value) error
+}
+`})
+
+	// The client lacks String, so it cannot be asserted to implement Store.
+	if err := generate(Config{Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(readFile(t, filepath.Join(dir, "store_client_gen.go")), "var _ Store") {
+		t.Error("client asserts the interface it does not implement")
+	}
+
+	goCommand(t, dir, "vet", "./...")
+
+	var invalidErr *InvalidMethodsError
+	if err := generate(Config{Strict: true}); !errors.As(err, &invalidErr) {
+		t.Fatalf("strict generation returned %v, want an *InvalidMethodsError", err)
+	}
+
+	if len(invalidErr.Diagnostics) != 1 || invalidErr.Diagnostics[0].Method != "fmt.Stringer" {
+		t.Errorf("diagnostics = %v", invalidErr.Diagnostics)
+	}
+}
+
+func TestGenerateImportClash(t *testing.T) {
+	const src = `package m
+
+import (
+	"context"
+
+	"example.com/m/rpc"
+)
+
+//rpc-gen:service
+type Store interface {
+	Put(ctx context.Context, req rpc.Req) error
+}
+`
+
+	dir := writeModule(t, map[string]string{"store.go": src, "rpc/rpc.go": "package rpc\n\ntype Req struct{ Key string }\n"})
+
+	if err := generate(Config{}); err == nil || !strings.Contains(err.Error(), "import it under another name") {
+		t.Fatalf("generation returned %v, want an error about the clashing import", err)
+	}
+
+	// Imported under another name, the package no longer clashes with net/rpc.
+	aliased := strings.NewReplacer(`"example.com/m/rpc"`, `xrpc "example.com/m/rpc"`, "rpc.Req", "xrpc.Req").Replace(src)
+	if err := os.WriteFile(filepath.Join(dir, "store.go"), []byte(aliased), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generate(Config{Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateParamsShadowingPackages(t *testing.T) {
+	dir := writeModule(t, map[string]string{"model/model.go": "package model\n\ntype Item struct{ Name string }\n", "shadow.go": `package m
+
+import (
+	"context"
+
+	"example.com/m/model"
+)
+
+type F struct{ N int }
+
+type R struct{ N int }
+
+//rpc-gen:service
+type Shadow interface {
+	A(ctx context.Context, fmt F) (*R, error)
+	B(context context.Context, rpc F) (*R, error)
+	C(ctx context.Context, time, errors int) (*R, error)
+	D(ctx context.Context, model model.Item) (*model.Item, error)
+	E(ctx context.Context, io, syscall F) error
+}
+`})
+
+	if err := generate(Config{Options: Options{Assert: true, Async: true, Retries: 2, Metadata: true, Pool: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestPoolRoundTrip(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conn answers Add with the index of the connection serving it.
+type conn struct {
+	arith
+	index int
+}
+
+func (c conn) Add(context.Context, Args) (*Reply, error) {
+	return &Reply{Sum: c.index}, nil
+}
+
+func TestPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var served sync.WaitGroup
+	go func() {
+		for index := 0; ; index++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			server := rpc.NewServer()
+			if err := server.RegisterName("Arith", NewArithServer(conn{index: index})); err != nil {
+				t.Error(err)
+				return
+			}
+
+			served.Add(1)
+			go func() {
+				defer served.Done()
+				server.ServeConn(c)
+			}()
+		}
+	}()
+
+	pool := NewArithPool(l.Addr().String())
+	ctx := context.Background()
+
+	// Calls take turns over the two connections, dialed in order.
+	for i, want := range []int{0, 1, 0, 1} {
+		reply, err := pool.Add(ctx, Args{})
+		if err != nil || reply.Sum != want {
+			t.Errorf("call %d served by connection %v, %v, want %d", i, reply, err, want)
+		}
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the pool closes every connection, ending ServeConn.
+	done := make(chan struct{})
+	go func() {
+		served.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("connections still open after Close")
+	}
+
+	if _, err := pool.Add(ctx, Args{}); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Add after Close = %v, want rpc.ErrShutdown", err)
+	}
+}
+
+func TestPoolDialContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A call whose context is done does not dial, so it cannot hold up the pool.
+	pool := NewArithPool("127.0.0.1:1")
+	if _, err := pool.Add(ctx, Args{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Add with a cancelled context = %v, want context.Canceled", err)
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{Pool: 2, Assert: true}}, arithService, test)
+}
+
+func TestPoolParamNamedP(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": strings.Replace(service, "Add(ctx context.Context, args Args)", "Add(ctx context.Context, p Args)", 1)})
+
+	if err := generate(Config{Options: Options{Pool: 2, Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestRetries(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{rpc.ErrShutdown, true},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{rpc.ServerError("connection is shut down"), false},
+		{context.Canceled, false},
+	} {
+		if got := retryableArith(tc.err); got != tc.want {
+			t.Errorf("retryableArith(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, 1600 * time.Millisecond, 3200 * time.Millisecond, 5 * time.Second, 5 * time.Second} {
+		if got := backoffArith(attempt); got != want {
+			t.Errorf("backoffArith(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestRetryRedials(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conns <- conn
+			go server.ServeConn(conn)
+		}
+	}()
+
+	client, err := NewArithClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Sum(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping the connection fails the next call, which redials and succeeds.
+	(<-conns).Close()
+
+	if sum, err := client.Sum(context.Background(), 1, 2); err != nil || sum != 3 {
+		t.Errorf("Sum after the connection dropped = %d, %v", sum, err)
+	}
+
+	<-conns
+
+	// Server errors are returned without retrying.
+	if err := client.Fail(context.Background()); err == nil {
+		t.Error("Fail succeeded")
+	}
+
+	select {
+	case <-conns:
+		t.Error("a server error redialed")
+	default:
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{Retries: 2, Assert: true}}, arithService, test)
+}
+
+func TestClientNetworkCodecOptions(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetworkCodec(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "arith.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+
+	// The client was generated for gob over tcp.
+	client, err := NewArithClient(l.Addr().String(), WithArithNetwork("unix"), WithArithCodec("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if sum, err := client.Sum(context.Background(), 1, 2); err != nil || sum != 3 {
+		t.Errorf("Sum = %d, %v", sum, err)
+	}
+
+	if _, err := NewArithClient(l.Addr().String(), WithArithNetwork("unix"), WithArithCodec("xml")); err == nil {
+		t.Error("dialing with an invalid codec succeeded")
+	}
+
+	if _, err := NewArithClient(l.Addr().String(), WithArithNetwork("http")); err == nil {
+		t.Error("dialing with an invalid network succeeded")
+	}
+}
+`
+
+	roundTrip(t, Config{}, arithService, test)
+}
+
+func TestTypedErrors(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"testing"
+)
+
+type counter struct{}
+
+func (counter) Count(context.Context) (int, error) {
+	return 0, errors.New("failed")
+}
+
+func TestRPCError(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var rpcErr *RPCError
+	if err := client.Fail(context.Background()); !errors.As(err, &rpcErr) || rpcErr.Method != MethodArithFail {
+		t.Fatalf("Fail = %v, want an *RPCError for %s", err, MethodArithFail)
+	}
+
+	var serverErr rpc.ServerError
+	if !errors.As(rpcErr, &serverErr) || serverErr != "failed" {
+		t.Errorf("RPCError wraps %v, want the server's error", rpcErr.Err)
+	}
+
+	// Services of the package share the type.
+	counterClient, err := NewCounterPipeClient(counter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer counterClient.Close()
+
+	if _, err := counterClient.Count(context.Background()); !errors.As(err, &rpcErr) || rpcErr.Method != MethodCounterCount {
+		t.Errorf("Count = %v, want an *RPCError for %s", err, MethodCounterCount)
+	}
+}
+`
+
+	src := arithService + `
+//rpc-gen:service
+type Counter interface {
+	Count(ctx context.Context) (int, error)
+}
+`
+
+	for _, singleFile := range []bool{false, true} {
+		t.Run(fmt.Sprintf("single-file=%t", singleFile), func(t *testing.T) {
+			roundTrip(t, Config{SingleFile: singleFile, Options: Options{TypedErrors: true, Assert: true}}, src, test)
+		})
+	}
+}
+
+// generateVetted writes files to a temporary module, generates them with c, vets
+// the result and returns the content of the generated file name.
+func generateVetted(t *testing.T, files map[string]string, c Config, name string) string {
+	t.Helper()
+
+	dir := writeModule(t, files)
+	if err := generate(c); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+
+	return readFile(t, filepath.Join(dir, name))
+}
+
+// model is a package of request and response types imported by services.
+const model = `package model
+
+type Req struct{ Key string }
+
+type Resp struct{ Value string }
+`
+
+func TestGenerateQualifiedTypes(t *testing.T) {
+	client := generateVetted(t, map[string]string{"model/model.go": model, "store.go": `package m
+
+import (
+	"context"
+
+	"example.com/m/model"
+)
+
+//rpc-gen:service
+type Store interface {
+	Get(ctx context.Context, req model.Req) (*model.Resp, error)
+}
+`}, Config{Options: Options{Assert: true}}, "store_client_gen.go")
+
+	for _, want := range []string{"Get(ctx context.Context, req model.Req) (*model.Resp, error)", "gob.Register(model.Req{})", "gob.Register(model.Resp{})", `"example.com/m/model"`} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestGenerateServiceMarker(t *testing.T) {
+	src := service + `
+// Helper is not an RPC service.
+type Helper interface {
+	Help(ctx context.Context) error
+}
+`
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "arith_client_gen.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "helper_client_gen.go")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unmarked interface is generated: %v", err)
+	}
+
+	if err := generate(Config{All: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "helper_client_gen.go")); err != nil {
+		t.Fatalf("unmarked interface is not generated with All: %v", err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestUnixNetwork(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnix(t *testing.T) {
+	if err := RegisterArithServer(NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "arith.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeArith(l)
+
+	client, err := NewArithClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if sum, err := client.Sum(context.Background(), 1, 2); err != nil || sum != 3 {
+		t.Errorf("Sum = %d, %v", sum, err)
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{Network: "unix"}}, arithService, test)
+}
+
+func TestGenerateJSONCodec(t *testing.T) {
+	client := generateVetted(t, map[string]string{"arith.go": service}, Config{Options: Options{Codec: "json"}}, "arith_client_gen.go")
+
+	if !strings.Contains(client, `"net/rpc/jsonrpc"`) {
+		t.Error("client does not import net/rpc/jsonrpc")
+	}
+
+	if strings.Contains(client, "gob.Register") {
+		t.Error("JSON client registers gob types")
+	}
+}
+
+func TestGenerateFileName(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	if err := generate(Config{FileName: "{{.Kind}}.{{lower .ServiceName}}{{.Suffix}}", Suffix: ".gen.go"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"client.arith.gen.go", "server.arith.gen.go"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Templates failing to execute or producing an empty or outside name are rejected.
+	for _, fileName := range []string{"{{.Missing}}", "{{if false}}x{{end}}", "../{{.ServiceName}}.go"} {
+		if err := generate(Config{FileName: fileName}); err == nil {
+			t.Errorf("file name template %q is accepted", fileName)
+		}
+	}
+}
+
+func TestContextOnlyMethod(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type Status struct{ OK bool }
+
+//rpc-gen:service
+type Health interface {
+	Check(ctx context.Context) (*Status, error)
+}
+
+type health struct{}
+
+func (health) Check(context.Context) (*Status, error) {
+	return &Status{OK: true}, nil
+}
+`
+
+	const test = `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	client, err := NewHealthPipeClient(health{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if status, err := client.Check(context.Background()); err != nil || !status.OK {
+		t.Errorf("Check = %v, %v", status, err)
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, test)
+
+	if client := readFile(t, "health_client_gen.go"); !strings.Contains(client, "Check(ctx context.Context) (*Status, error)") || !strings.Contains(client, "struct{}{}") {
+		t.Error("client does not send an empty request for Check")
+	}
+}
+
+func TestErrorOnlyMethod(t *testing.T) {
+	const src = `package m
+
+import (
+	"context"
+	"sync"
+)
+
+type DeleteReq struct{ Key string }
+
+//rpc-gen:service
+type Store interface {
+	Delete(ctx context.Context, req DeleteReq) error
+}
+
+type store struct {
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (s *store) Delete(_ context.Context, req DeleteReq) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleted = append(s.deleted, req.Key)
+
+	return nil
+}
+`
+
+	const test = `package m
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	impl := &store{}
+	client, err := NewStorePipeClient(impl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Delete(context.Background(), DeleteReq{Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(impl.deleted, []string{"a"}) {
+		t.Errorf("deleted %v", impl.deleted)
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, test)
+
+	if client := readFile(t, "store_client_gen.go"); !strings.Contains(client, "Delete(ctx context.Context, req DeleteReq) error {") {
+		t.Error("client does not declare Delete returning only an error")
+	}
+}
+
+func TestPointerRequest(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type Req struct{ N int }
+
+type Resp struct{ N int }
+
+//rpc-gen:service
+type Doubler interface {
+	Double(ctx context.Context, req *Req) (*Resp, error)
+}
+
+type doubler struct{}
+
+func (doubler) Double(_ context.Context, req *Req) (*Resp, error) {
+	return &Resp{N: 2 * req.N}, nil
+}
+`
+
+	const test = `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDouble(t *testing.T) {
+	client, err := NewDoublerPipeClient(doubler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if resp, err := client.Double(context.Background(), &Req{N: 2}); err != nil || resp.N != 4 {
+		t.Errorf("Double = %v, %v", resp, err)
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, test)
+
+	client := readFile(t, "doubler_client_gen.go")
+	if !strings.Contains(client, "Double(ctx context.Context, req *Req)") || !strings.Contains(client, "gob.Register(Req{})") {
+		t.Error("client does not take *Req and register Req")
+	}
+}
+
+func TestGenerateGobRegisterOnce(t *testing.T) {
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Sub(ctx context.Context, args Args) (*Reply, error)", 1)
+	client := generateVetted(t, map[string]string{"arith.go": src}, Config{}, "arith_client_gen.go")
+
+	for _, registration := range []string{"gob.Register(Args{})", "gob.Register(Reply{})"} {
+		if n := strings.Count(client, registration); n != 1 {
+			t.Errorf("%s appears %d times, want once", registration, n)
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	const test = `package m
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The generated default of a nanosecond expires before the connection is made.
+	var netErr net.Error
+	if _, err := NewArithClient(l.Addr().String()); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("NewArithClient = %v, want a timeout", err)
+	}
+
+	client, err := NewArithClientTimeout(l.Addr().String(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+`
+
+	roundTrip(t, Config{Options: Options{DialTimeout: time.Nanosecond}}, arithService, test)
+}
+
+func TestGenerateClientInterface(t *testing.T) {
+	client := generateVetted(t, map[string]string{"arith.go": service}, Config{Options: Options{ClientIface: true}}, "arith_client_gen.go")
+
+	for _, want := range []string{
+		"type ArithClientInterface interface {",
+		"Add(ctx context.Context, argsArg Args) (*Reply, error)\n\tReset(ctx context.Context) error\n\tClose() error\n}",
+		"var _ ArithClientInterface = (*ArithClient)(nil)",
+	} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestGenerateRecursive(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"services/arith/arith.go": strings.Replace(service, "package m", "package arith", 1),
+		"services/store/store.go": `package store
+
+import "context"
+
+type Key struct{ Name string }
+
+//rpc-gen:service
+type Store interface {
+	Get(ctx context.Context, key Key) (string, error)
+}
+`,
+	})
+
+	if err := generate(Config{Input: "./services"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "services", "arith", "arith_client_gen.go")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("subpackage is generated without Recursive: %v", err)
+	}
+
+	if err := generate(Config{Input: "./services", Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for pkg, file := range map[string]string{"arith": "arith_client_gen.go", "store": "store_client_gen.go"} {
+		client := readFile(t, filepath.Join(dir, "services", pkg, file))
+		if !strings.Contains(client, "\npackage "+pkg+"\n") {
+			t.Errorf("%s has the wrong package clause", file)
+		}
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateSliceMapTypes(t *testing.T) {
+	client := generateVetted(t, map[string]string{"catalog.go": `package m
+
+import "context"
+
+type Item struct{ Name string }
+
+//rpc-gen:service
+type Catalog interface {
+	BatchGet(ctx context.Context, ids []string) (*[]Item, error)
+	Counts(ctx context.Context, names []string) (map[string]int, error)
+}
+`}, Config{Options: Options{Assert: true}}, "catalog_client_gen.go")
+
+	for _, want := range []string{
+		"BatchGet(ctx context.Context, ids []string) (*[]Item, error)",
+		"Counts(ctx context.Context, names []string) (map[string]int, error)",
+		"gob.Register([]Item{})",
+	} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+
+	// Slices and maps of builtin types need no registration.
+	for _, unwanted := range []string{"gob.Register([]string{})", "gob.Register(map[string]int{})"} {
+		if strings.Contains(client, unwanted) {
+			t.Errorf("client contains %q", unwanted)
+		}
+	}
+}
+
+func TestGeneratePackage(t *testing.T) {
+	client := generateVetted(t, map[string]string{"arith.go": service}, Config{Output: "clients", Package: "clients", Options: Options{Assert: true}}, "clients/arith_client_gen.go")
+
+	for _, want := range []string{"\npackage clients\n", `"example.com/m"`, "Add(ctx context.Context, argsArg m.Args) (*m.Reply, error)", "var _ m.Arith = (*ArithClient)(nil)"} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestGenerateCustomTemplate(t *testing.T) {
+	const custom = `// Code generated by rpc-gen; DO NOT EDIT.
+
+package {{.PackageName}}
+
+// {{.ServiceName}}Methods lists the methods of {{.ServiceName}}.
+var {{.ServiceName}}Methods = []string{ {{- range .Methods}}"{{.Name}}", {{end -}} }
+`
+
+	dir := writeModule(t, map[string]string{"arith.go": service, "custom.tmpl": custom})
+
+	// Regenerating checks the custom output is recognized as generated.
+	for range 2 {
+		if err := generate(Config{Template: "custom.tmpl"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := readFile(t, filepath.Join(dir, "arith_client_gen.go"))
+	if want := `var ArithMethods = []string{"Add", "Reset"}`; !strings.Contains(client, want) {
+		t.Errorf("client is missing %q:\n%s", want, client)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestContextDeadline(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+//rpc-gen:service
+type Slow interface {
+	Wait(ctx context.Context) error
+}
+
+// slow blocks every call until release is closed.
+type slow struct{ release chan struct{} }
+
+func (s slow) Wait(context.Context) error {
+	<-s.release
+	return nil
+}
+`
+
+	const test = `package m
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	impl := slow{release: make(chan struct{})}
+
+	client, err := NewSlowPipeClient(impl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := client.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait = %v, want context.DeadlineExceeded", err)
+	}
+
+	// The abandoned call completes in the background and leaves the client usable.
+	close(impl.release)
+
+	if err := client.Wait(context.Background()); err != nil {
+		t.Errorf("Wait after release = %v", err)
+	}
+}
+`
+
+	roundTrip(t, Config{}, src, test)
+}
+
+func TestGenerateNoRegister(t *testing.T) {
+	client := generateVetted(t, map[string]string{"arith.go": service}, Config{Options: Options{NoRegister: true}}, "arith_client_gen.go")
+
+	for _, unwanted := range []string{"func init()", "gob.Register", `"encoding/gob"`} {
+		if strings.Contains(client, unwanted) {
+			t.Errorf("client contains %q", unwanted)
+		}
+	}
+}
+
+func TestHTTPNetwork(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestHTTP(t *testing.T) {
+	if err := RegisterArithServer(NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeArith(l)
+
+	client, err := NewArithClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if reply, err := client.Add(context.Background(), Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+}
+`
+
+	for _, path := range []string{"", "/rpc"} {
+		t.Run("path="+path, func(t *testing.T) {
+			roundTrip(t, Config{Options: Options{Network: "http", HTTPPath: path}}, arithService, test)
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	if err := RegisterArithServer(NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeArith(l)
+
+	client, err := NewArithClientTLS(l.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if reply, err := client.Add(context.Background(), Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+
+	// A client that does not trust the certificate fails the handshake.
+	if client, err := NewArithClientTLS(l.Addr().String(), &tls.Config{}); err == nil {
+		client.Close()
+		t.Error("NewArithClientTLS trusted an unknown certificate")
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{TLS: true}}, arithService, test)
+}
+
+func TestGenerateMethodDoc(t *testing.T) {
+	src := strings.Replace(service, "\tAdd(", "\t// Add sums the arguments.\n\t//\n\t// It never fails.\n\tAdd(", 1)
+	client := generateVetted(t, map[string]string{"arith.go": src}, Config{}, "arith_client_gen.go")
+
+	if want := "// Add sums the arguments.\n//\n// It never fails.\nfunc (c *ArithClient) Add("; !strings.Contains(client, want) {
+		t.Errorf("client is missing %q", want)
+	}
+}
+
+func TestGenerateUnexportedTypes(t *testing.T) {
+	src := service + `
+type fooRequest struct{ Name string }
+
+type fooResponse struct{ Name string }
+
+//rpc-gen:service
+type Foo interface {
+	Get(ctx context.Context, req fooRequest) (*Reply, error)
+	Put(ctx context.Context, args Args) (*fooResponse, error)
+	Set(ctx context.Context, args Args) (*Reply, error)
+}
+`
+	writeModule(t, map[string]string{"arith.go": src})
+
+	var invalidErr *InvalidMethodsError
+	if err := generate(Config{Strict: true}); !errors.As(err, &invalidErr) {
+		t.Fatalf("strict generation returned %v, want an *InvalidMethodsError", err)
+	}
+
+	var got []string
+	for _, diagnostic := range invalidErr.Diagnostics {
+		diagnostic.Pos.Filename = filepath.Base(diagnostic.Pos.Filename)
+		got = append(got, diagnostic.String())
+	}
+
+	want := []string{
+		"arith.go:21: Foo.Get request type must be exported",
+		"arith.go:22: Foo.Put response type must be exported",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateAsync(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprint(async), func(t *testing.T) {
+			client := generateVetted(t, map[string]string{"arith.go": service}, Config{Options: Options{Async: async}}, "arith_client_gen.go")
+
+			for _, method := range []string{"Add", "Reset"} {
+				if !strings.Contains(client, "func (c *ArithClient) "+method+"(") {
+					t.Errorf("client is missing %s", method)
+				}
+
+				if got := strings.Contains(client, "func (c *ArithClient) "+method+"Async("); got != async {
+					t.Errorf("client declares %sAsync: %t, want %t", method, got, async)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateInterfacesPerFile(t *testing.T) {
+	src := service + `
+//rpc-gen:service
+type Calc interface {
+	Add(ctx context.Context, args Args) (*Reply, error)
+	Reset(n int) error
+}
+`
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	if err := generate(Config{Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Calc's invalid Reset neither drops Arith's nor its assertion.
+	arith := readFile(t, filepath.Join(dir, "arith_client_gen.go"))
+	for _, want := range []string{`"Arith.Add"`, `"Arith.Reset"`, "var _ Arith = (*ArithClient)(nil)"} {
+		if !strings.Contains(arith, want) {
+			t.Errorf("arith client is missing %q", want)
+		}
+	}
+
+	calc := readFile(t, filepath.Join(dir, "calc_client_gen.go"))
+	if !strings.Contains(calc, `"Calc.Add"`) || strings.Contains(calc, "Reset") || strings.Contains(calc, "var _ Calc") {
+		t.Error("calc client lacks Add, or declares the invalid Reset or asserts the interface")
+	}
+
+	goCommand(t, dir, "vet", "./...")
+
+	var invalidErr *InvalidMethodsError
+	if err := generate(Config{Strict: true}); !errors.As(err, &invalidErr) {
+		t.Fatalf("strict generation returned %v, want an *InvalidMethodsError", err)
+	}
+
+	if len(invalidErr.Diagnostics) != 1 || invalidErr.Diagnostics[0].Service != "Calc" {
+		t.Errorf("diagnostics = %v", invalidErr.Diagnostics)
+	}
+}
+
+func TestPackedParams(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type Result struct{ Value int }
+
+//rpc-gen:service
+type Calc interface {
+	Mul(ctx context.Context, a int, b int, scale float64) (*Result, error)
+}
+
+type calc struct{}
+
+func (calc) Mul(_ context.Context, a int, b int, scale float64) (*Result, error) {
+	return &Result{Value: int(float64(a*b) * scale)}, nil
+}
+`
+
+	const test = `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMul(t *testing.T) {
+	client, err := NewCalcPipeClient(calc{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if result, err := client.Mul(context.Background(), 2, 3, 1.5); err != nil || result.Value != 9 {
+		t.Errorf("Mul = %v, %v", result, err)
+	}
+}
+`
+
+	roundTrip(t, Config{}, src, test)
+
+	types := readFile(t, "calc_types_gen.go")
+	if want := "type CalcMulRequest struct {\n\tA     int\n\tB     int\n\tScale float64\n}"; !strings.Contains(types, want) {
+		t.Errorf("types are missing %q:\n%s", want, types)
+	}
+}
+
+// captureStdout returns what f writes to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stdout := os.Stdout
+	os.Stdout = file
+	defer func() { os.Stdout = stdout }()
+
+	f()
+
+	return readFile(t, file.Name())
+}
+
+func TestGenerateDryRun(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	report := captureStdout(t, func() {
+		if err := generate(Config{DryRun: true}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	for _, want := range []string{"Arith (", "  client: " + filepath.Join(dir, "arith_client_gen.go"), "  Add(Args) (*Reply, error)\n", "  Reset(struct{}) error\n"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Errorf("dry run wrote files: %v", entries)
+	}
+}
+
+func TestGenerateHeader(t *testing.T) {
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Reset(ctx context.Context, a, b int) error", 1)
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+	for _, name := range []string{"arith_client_gen.go", "arith_server_gen.go", "arith_types_gen.go"} {
+		lines := strings.Split(strings.TrimSpace(readFile(t, filepath.Join(dir, name))), "\n")
+		if !header.MatchString(lines[0]) || lines[1] != "// Source: arith.go (Arith)" {
+			t.Errorf("%s begins with %q", name, lines[:2])
+		}
+	}
+}
+
+func TestResponseByValue(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type Args struct{ A, B int }
+
+type Reply struct{ Sum int }
+
+//rpc-gen:service
+type Arith interface {
+	Add(ctx context.Context, args Args) (Reply, error)
+	AddPtr(ctx context.Context, args Args) (*Reply, error)
+}
+
+type arith struct{}
+
+func (arith) Add(_ context.Context, args Args) (Reply, error) {
+	return Reply{Sum: args.A + args.B}, nil
+}
+
+func (arith) AddPtr(_ context.Context, args Args) (*Reply, error) {
+	return &Reply{Sum: args.A + args.B}, nil
+}
+`
+
+	const test = `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	var reply Reply
+	if reply, err = client.Add(ctx, Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+
+	var replyPtr *Reply
+	if replyPtr, err = client.AddPtr(ctx, Args{A: 1, B: 2}); err != nil || replyPtr.Sum != 3 {
+		t.Errorf("AddPtr = %v, %v", replyPtr, err)
+	}
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, test)
+}
+
+func TestGenerateConcurrently(t *testing.T) {
+	const handWritten = "package m\n"
+
+	files := map[string]string{"args.go": "package m\n\ntype Args struct{ A, B int }\n\ntype Reply struct{ Sum int }\n"}
+	for i := range 16 {
+		files[fmt.Sprintf("svc%d.go", i)] = fmt.Sprintf("package m\n\nimport \"context\"\n\n//rpc-gen:service\ntype Svc%d interface {\n\tAdd(ctx context.Context, args Args) (*Reply, error)\n}\n", i)
+	}
+
+	// The hand-written files make two services fail without stopping the others.
+	files["svc3_client_gen.go"] = handWritten
+	files["svc11_client_gen.go"] = handWritten
+	dir := writeModule(t, files)
+
+	err := generate(Config{})
+	for _, failed := range []string{"svc3_client_gen.go", "svc11_client_gen.go"} {
+		if err == nil || !strings.Contains(err.Error(), failed) {
+			t.Errorf("generation returned %v, want an error about %s", err, failed)
+		}
+	}
+
+	for i := range 16 {
+		if i == 3 || i == 11 {
+			continue
+		}
+
+		for _, kind := range []string{"client", "server"} {
+			if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("svc%d_%s_gen.go", i, kind))); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestServiceNameDirective(t *testing.T) {
+	src := strings.Replace(arithService, "//rpc-gen:service\n", "//rpc-gen:service\n//rpc-gen:name=math.v1.Arith\n", 1)
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAdd(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if reply, err := client.Add(context.Background(), Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+}
+`)
+
+	client := readFile(t, "arith_client_gen.go")
+	if !strings.Contains(client, `"math.v1.Arith.Add"`) || strings.Contains(client, `"Arith.Add"`) {
+		t.Error("client does not call the service by its directive name")
+	}
+
+	if server := readFile(t, "arith_server_gen.go"); !strings.Contains(server, `rpc.RegisterName("math.v1.Arith", server)`) {
+		t.Error("server does not register the service under its directive name")
+	}
+}
+
+func TestGenerateCollision(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"a/arith.go": strings.Replace(service, "package m", "package a", 1),
+		"b/arith.go": strings.Replace(service, "package m", "package b", 1),
+	})
+
+	err := generate(Config{Output: "clients", Package: "clients"})
+	if err == nil {
+		t.Fatal("generating two services into the same files succeeded")
+	}
+
+	for _, want := range []string{
+		filepath.Join("clients", "arith_client_gen.go") + " is generated by both",
+		filepath.Join(dir, "a", "arith.go"),
+		filepath.Join(dir, "b", "arith.go"),
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "clients")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("conflicting services were written: %v", err)
+	}
+}
+
+func TestGenerateGenericInterface(t *testing.T) {
+	src := service + `
+type IDReq struct{ ID string }
+
+//rpc-gen:service
+type Store[T any] interface {
+	Get(ctx context.Context, id IDReq) (*T, error)
+}
+`
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	var log strings.Builder
+	if err := Generate(Config{Logger: slog.New(slog.NewTextHandler(&log, nil))}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(log.String(), `level=WARN msg="Skipping generic interface" name=Store`) {
+		t.Errorf("log does not report the skipped interface:\n%s", log.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "store_client_gen.go")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("generic interface is generated: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "arith_client_gen.go")); err != nil {
+		t.Error(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestExposeConn(t *testing.T) {
+	roundTrip(t, Config{Options: Options{ExposeConn: true}}, arithService, `package m
+
+import "testing"
+
+func TestConn(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply Reply
+	if err := client.Conn().Call("Arith.Add", Args{A: 1, B: 2}, &reply); err != nil || reply.Sum != 3 {
+		t.Errorf("Call = %v, %v", reply, err)
+	}
+}
+`)
+
+	if client := readFile(t, "arith_client_gen.go"); !strings.Contains(client, "func (c *ArithClient) Conn() *rpc.Client {") {
+		t.Error("client is missing the Conn accessor")
+	}
+}
+
+func TestGenerateForeignPackageRegistrations(t *testing.T) {
+	client := generateVetted(t, map[string]string{"arith.go": service}, Config{Output: "clients", Package: "clients"}, "clients/arith_client_gen.go")
+
+	for _, want := range []string{"gob.Register(m.Args{})", "gob.Register(m.Reply{})"} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+
+	if strings.Contains(client, "gob.Register(Args{})") || strings.Contains(client, "gob.Register(Reply{})") {
+		t.Error("client registers unqualified source types")
+	}
+}
+
+func TestVariadic(t *testing.T) {
+	roundTrip(t, Config{Options: Options{Assert: true}}, arithService, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSum(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	for _, values := range [][]int{nil, {4}, {4, 5, 6}} {
+		want := 0
+		for _, value := range values {
+			want += value
+		}
+
+		if sum, err := client.Sum(ctx, values...); err != nil || sum != want {
+			t.Errorf("Sum(%v) = %d, %v, want %d", values, sum, err, want)
+		}
+	}
+}
+`)
+
+	if client := readFile(t, "arith_client_gen.go"); !strings.Contains(client, "Sum(ctx context.Context, values ...int) (int, error)") {
+		t.Error("client does not declare Sum as variadic")
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	const src = arithService + `
+//rpc-gen:service
+type Calc interface {
+	Add(ctx context.Context, args Args) (*Reply, error)
+	Mul(ctx context.Context, a, b int) (int, error)
+}
+
+type calc struct{ arith }
+
+func (calc) Mul(_ context.Context, a, b int) (int, error) {
+	return a * b, nil
+}
+`
+
+	roundTrip(t, Config{SingleFile: true, Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestServices(t *testing.T) {
+	ctx := context.Background()
+
+	arithClient, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer arithClient.Close()
+
+	if reply, err := arithClient.Add(ctx, Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Arith.Add = %v, %v", reply, err)
+	}
+
+	calcClient, err := NewCalcPipeClient(calc{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer calcClient.Close()
+
+	if reply, err := calcClient.Add(ctx, Args{A: 2, B: 3}); err != nil || reply.Sum != 5 {
+		t.Errorf("Calc.Add = %v, %v", reply, err)
+	}
+
+	if product, err := calcClient.Mul(ctx, 2, 3); err != nil || product != 6 {
+		t.Errorf("Calc.Mul = %d, %v", product, err)
+	}
+}
+`)
+
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generated []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), "_gen.go") {
+			generated = append(generated, entry.Name())
+		}
+	}
+
+	if want := []string{"clients_gen.go", "servers_gen.go", "types_gen.go"}; strings.Join(generated, " ") != strings.Join(want, " ") {
+		t.Errorf("generated files = %v, want %v", generated, want)
+	}
+
+	clients := readFile(t, "clients_gen.go")
+	for _, registration := range []string{"gob.Register(Args{})", "gob.Register(Reply{})"} {
+		if n := strings.Count(clients, registration); n != 1 {
+			t.Errorf("%s appears %d times, want once", registration, n)
+		}
+	}
+
+	if n := strings.Count(clients, "\npackage m\n"); n != 1 {
+		t.Errorf("clients_gen.go has %d package clauses, want one", n)
+	}
+}
+
+func TestGenerateAliasedContext(t *testing.T) {
+	src := strings.NewReplacer(`import "context"`, `import stdctx "context"`, "context.Context", "stdctx.Context").Replace(service)
+	client := generateVetted(t, map[string]string{"arith.go": src}, Config{Options: Options{Assert: true}}, "arith_client_gen.go")
+
+	for _, want := range []string{`"Arith.Add"`, `"Arith.Reset"`, "var _ Arith = (*ArithClient)(nil)"} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestGenerateInvalidContext(t *testing.T) {
+	src := service + `
+type pkg struct{ Context int }
+
+//rpc-gen:service
+type Bad interface {
+	Plain(n int, args Args) (*Reply, error)
+	Nested(ctx pkg.Context, args Args) (*Reply, error)
+}
+`
+	writeModule(t, map[string]string{"arith.go": src})
+
+	var invalidErr *InvalidMethodsError
+	if err := generate(Config{Strict: true}); !errors.As(err, &invalidErr) {
+		t.Fatalf("strict generation returned %v, want an *InvalidMethodsError", err)
+	}
+
+	var got []string
+	for _, diagnostic := range invalidErr.Diagnostics {
+		got = append(got, diagnostic.Method+" "+diagnostic.Reason)
+	}
+
+	want := []string{"Plain first parameter must be context.Context", "Nested first parameter must be context.Context"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+}
+
+func TestGenericResponse(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type Item struct{ Name string }
+
+type Page[T any] struct {
+	Items []T
+	Next  string
+}
+
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+type ListReq struct{ Limit int }
+
+//rpc-gen:service
+type Catalog interface {
+	List(ctx context.Context, req ListReq) (*Page[Item], error)
+	First(ctx context.Context, req ListReq) (*Pair[string, Item], error)
+}
+
+type catalog struct{}
+
+func (catalog) List(_ context.Context, req ListReq) (*Page[Item], error) {
+	return &Page[Item]{Items: make([]Item, req.Limit), Next: "2"}, nil
+}
+
+func (catalog) First(context.Context, ListReq) (*Pair[string, Item], error) {
+	return &Pair[string, Item]{Key: "a", Value: Item{Name: "first"}}, nil
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	client, err := NewCatalogPipeClient(catalog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	if page, err := client.List(ctx, ListReq{Limit: 2}); err != nil || len(page.Items) != 2 || page.Next != "2" {
+		t.Errorf("List = %v, %v", page, err)
+	}
+
+	if pair, err := client.First(ctx, ListReq{}); err != nil || pair.Value.Name != "first" {
+		t.Errorf("First = %v, %v", pair, err)
+	}
+}
+`)
+
+	client := readFile(t, "catalog_client_gen.go")
+	for _, want := range []string{"gob.Register(Page[Item]{})", "gob.Register(Pair[string, Item]{})"} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestGenerateManifest(t *testing.T) {
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Reset(ctx context.Context, a, b int) error", 1)
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	c := Config{Manifest: "manifest.json", DryRun: true, Options: Options{Async: true}}
+	captureStdout(t, func() {
+		if err := generate(c); err != nil {
+			t.Error(err)
+		}
+	})
+
+	var manifest []ServiceData
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "manifest.json"))), &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := parse(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(manifest, want) {
+		t.Errorf("manifest = %+v, want %+v", manifest, want)
+	}
+
+	if len(manifest) != 1 || len(manifest[0].Methods) != 2 || manifest[0].Methods[1].RequestType != "ArithResetRequest" || !manifest[0].Async {
+		t.Errorf("manifest does not describe Arith: %+v", manifest)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	roundTrip(t, Config{Options: Options{Reconnect: true, Assert: true}}, arithService, `package m
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func TestReconnect(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conns <- conn
+			go server.ServeConn(conn)
+		}
+	}()
+
+	client, err := NewArithClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	// Every dropped connection is redialed by the next call, which then succeeds.
+	for i := range 3 {
+		if reply, err := client.Add(ctx, Args{A: i, B: 1}); err != nil || reply.Sum != i+1 {
+			t.Fatalf("Add after %d dropped connections = %v, %v", i, reply, err)
+		}
+
+		(<-conns).Close()
+	}
+
+	// A closed client does not redial.
+	client.Close()
+	if _, err := client.Add(ctx, Args{}); err == nil {
+		t.Error("Add on a closed client succeeded")
+	}
+
+	select {
+	case <-conns:
+		t.Error("a closed client redialed")
+	default:
+	}
+}
+`)
+}
+
+// strictDiagnostics generates src with Strict and returns the method and reason of
+// each reported diagnostic.
+func strictDiagnostics(t *testing.T, src string) []string {
+	t.Helper()
+
+	writeModule(t, map[string]string{"service.go": src})
+
+	var invalidErr *InvalidMethodsError
+	if err := generate(Config{Strict: true}); !errors.As(err, &invalidErr) {
+		t.Fatalf("strict generation returned %v, want an *InvalidMethodsError", err)
+	}
+
+	var diagnostics []string
+	for _, diagnostic := range invalidErr.Diagnostics {
+		diagnostics = append(diagnostics, diagnostic.Method+" "+diagnostic.Reason)
+	}
+
+	return diagnostics
+}
+
+func TestGenerateInterfaceRequest(t *testing.T) {
+	got := strictDiagnostics(t, service+`
+type Shape interface{ Area() float64 }
+
+//rpc-gen:service
+type Geometry interface {
+	Named(ctx context.Context, shape Shape) (*Reply, error)
+	Any(ctx context.Context, value any) (*Reply, error)
+	Struct(ctx context.Context, args Args) (*Reply, error)
+}
+`)
+
+	want := []string{"Named request type must be concrete, not an interface", "Any request type must be concrete, not an interface"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateFileHeader(t *testing.T) {
+	const header = "// Copyright 2026 Example Inc.\n// SPDX-License-Identifier: MIT\n"
+
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Reset(ctx context.Context, a, b int) error", 1)
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	if err := generate(Config{Options: Options{Header: header}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"arith_client_gen.go", "arith_server_gen.go", "arith_types_gen.go"} {
+		if got := readFile(t, filepath.Join(dir, name)); !strings.HasPrefix(got, header+"\n"+generatedHeader+"\n") {
+			t.Errorf("%s does not begin with the header and the generated-code marker:\n%s", name, got)
+		}
+	}
+
+	// Files beginning with the header are still recognized as generated.
+	if err := generate(Config{Options: Options{Header: header}}); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestServeCodec(t *testing.T) {
+	const test = `package m
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+)
+
+// codec is the codec the server was generated for.
+const codec = "CODEC"
+
+func TestServe(t *testing.T) {
+	if err := RegisterArithServer(NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeArith(l)
+
+	// The server is reached without the generated client, speaking the codec directly.
+	dial := rpc.Dial
+	if codec == "json" {
+		dial = jsonrpc.Dial
+	}
+
+	client, err := dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply Reply
+	if err := client.Call("Arith.Add", Args{A: 1, B: 2}, &reply); err != nil || reply.Sum != 3 {
+		t.Errorf("Arith.Add = %v, %v", reply, err)
+	}
+}
+`
+
+	for _, codec := range []string{"gob", "json"} {
+		t.Run(codec, func(t *testing.T) {
+			roundTrip(t, Config{Options: Options{Codec: codec}}, arithService, strings.ReplaceAll(test, "CODEC", codec))
+		})
+	}
+}
+
+func TestMethodConstants(t *testing.T) {
+	src := strings.Replace(arithService, "//rpc-gen:service\n", "//rpc-gen:service\n//rpc-gen:name=math.Arith\n", 1)
+
+	roundTrip(t, Config{}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMethodConstants(t *testing.T) {
+	for got, want := range map[string]string{MethodArithAdd: "math.Arith.Add", MethodArithSum: "math.Arith.Sum", MethodArithFail: "math.Arith.Fail"} {
+		if got != want {
+			t.Errorf("constant = %q, want %q", got, want)
+		}
+	}
+
+	var methods []string
+	record := func(ctx context.Context, method string, req any, invoke func() error) error {
+		methods = append(methods, method)
+		return invoke()
+	}
+
+	client, err := NewArithPipeClient(arith{}, WithArithInterceptor(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Add(context.Background(), Args{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(methods) != 1 || methods[0] != MethodArithAdd {
+		t.Errorf("interceptor saw %q, want %q", methods, MethodArithAdd)
+	}
+}
+`)
+
+	// The calls use the constant rather than spelling out the RPC name.
+	if n := strings.Count(readFile(t, "arith_client_gen.go"), `"math.Arith.Add"`); n != 1 {
+		t.Errorf(`"math.Arith.Add" appears %d times, want once`, n)
+	}
+}
+
+func TestGenerateDoublePointerResponse(t *testing.T) {
+	got := strictDiagnostics(t, service+`
+//rpc-gen:service
+type Deep interface {
+	Get(ctx context.Context, args Args) (**Reply, error)
+	Set(ctx context.Context, args Args) (*Reply, error)
+}
+`)
+
+	if want := "Get response type must be T or *T, not a pointer to a pointer"; len(got) != 1 || got[0] != want {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+
+	// Without Strict, the other methods are still generated and compile.
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if client := readFile(t, "deep_client_gen.go"); strings.Contains(client, "Get(") || !strings.Contains(client, "Set(") {
+		t.Error("client declares Get or lacks Set")
+	}
+
+	goCommand(t, ".", "vet", "./...")
+}
+
+func TestGenerateIgnoreDirective(t *testing.T) {
+	src := service + `
+// Options is not a service.
+//
+//rpc-gen:ignore
+type Options interface {
+	Apply(ctx context.Context, args Args) (*Reply, error)
+}
+`
+	dir := writeModule(t, map[string]string{"arith.go": src})
+
+	// The marker opts out even in All mode, and even with the service marker.
+	for _, src := range []string{src, strings.Replace(src, "//rpc-gen:ignore", "//rpc-gen:service\n//rpc-gen:ignore", 1)} {
+		if err := os.WriteFile(filepath.Join(dir, "arith.go"), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := generate(Config{All: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "options_client_gen.go")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("ignored interface is generated: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "arith_client_gen.go")); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCloseMethod(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type CloseReq struct{ ID string }
+
+type CloseResp struct{ Closed string }
+
+//rpc-gen:service
+type Sessions interface {
+	Close(ctx context.Context, req CloseReq) (*CloseResp, error)
+	CloseConn(ctx context.Context, req CloseReq) (*CloseResp, error)
+}
+
+type sessions struct{}
+
+func (sessions) Close(_ context.Context, req CloseReq) (*CloseResp, error) {
+	return &CloseResp{Closed: req.ID}, nil
+}
+
+func (sessions) CloseConn(_ context.Context, req CloseReq) (*CloseResp, error) {
+	return &CloseResp{Closed: "conn " + req.ID}, nil
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestClose(t *testing.T) {
+	client, err := NewSessionsPipeClient(sessions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if resp, err := client.Close(ctx, CloseReq{ID: "a"}); err != nil || resp.Closed != "a" {
+		t.Errorf("Close = %v, %v", resp, err)
+	}
+
+	if resp, err := client.CloseConn(ctx, CloseReq{ID: "b"}); err != nil || resp.Closed != "conn b" {
+		t.Errorf("CloseConn = %v, %v", resp, err)
+	}
+
+	// The connection closer is renamed past both RPC methods.
+	if err := client.CloseConn2(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Close(ctx, CloseReq{ID: "c"}); err == nil {
+		t.Error("Close succeeded after closing the connection")
+	}
+}
+`)
+}
+
+func TestFormatGenerated(t *testing.T) {
+	const src = `package m
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+	model "example.com/m/model"
+)
+
+func f(v model.Req) error { return fmt.Errorf("%v", v) }
+`
+
+	imports := []Import{{Path: "fmt", PackageName: "fmt"}, {Path: "net/rpc", PackageName: "rpc"}, {Path: "time", PackageName: "time"}, {Name: "model", Path: "example.com/m/model"}}
+
+	formatted, err := formatGenerated([]byte(src), imports)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const want = `package m
+
+import (
+	model "example.com/m/model"
+	"fmt"
+)
+
+func f(v model.Req) error { return fmt.Errorf("%v", v) }
+`
+	if string(formatted) != want {
+		t.Errorf("formatted =\n%s\nwant\n%s", formatted, want)
+	}
+}
+
+func TestGenerateWithoutImportResolution(t *testing.T) {
+	// Nothing can be downloaded or found in a module cache, so only the imports the
+	// built-in templates declare are available.
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOMODCACHE", t.TempDir())
+
+	client := generateVetted(t, map[string]string{"model/model.go": model, "store.go": `package m
+
+import (
+	"context"
+
+	"example.com/m/model"
+)
+
+//rpc-gen:service
+type Store interface {
+	Get(ctx context.Context, req model.Req) (*model.Resp, error)
+}
+`}, Config{Options: Options{Codec: "json", Async: true, Pool: 2}}, "store_client_gen.go")
+
+	if !strings.Contains(client, `"example.com/m/model"`) || !strings.Contains(client, `"net/rpc/jsonrpc"`) {
+		t.Error("client is missing its imports")
+	}
+}
+
+func TestErrorAlias(t *testing.T) {
+	src := strings.NewReplacer(
+		"Fail(ctx context.Context) error", "Fail(ctx context.Context) Error",
+		"func (arith) Fail(context.Context) error {", "func (arith) Fail(context.Context) Error {",
+		"type arith struct{}", "// Error is the error type of the service.\ntype Error = error\n\ntype arith struct{}",
+	).Replace(arithService)
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"testing"
+)
+
+func TestFail(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var serverErr rpc.ServerError
+	if err := client.Fail(context.Background()); !errors.As(err, &serverErr) || serverErr != "failed" {
+		t.Errorf("Fail = %v", err)
+	}
+}
+`)
+
+	// The alias denotes the identical type, so the client returns error itself.
+	if client := readFile(t, "arith_client_gen.go"); !strings.Contains(client, "func (c *ArithClient) Fail(ctx context.Context) error {") {
+		t.Error("client does not declare Fail")
+	}
+}
+
+func TestTimeoutDirective(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+//rpc-gen:service
+type Slow interface {
+	// Wait blocks until released.
+	//
+	//rpc-gen:timeout=200ms
+	Wait(ctx context.Context) error
+}
+
+// slow blocks every call until release is closed.
+type slow struct{ release chan struct{} }
+
+func (s slow) Wait(context.Context) error {
+	<-s.release
+	return nil
+}
+`
+
+	roundTrip(t, Config{}, src, `package m
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	impl := slow{release: make(chan struct{})}
+	defer close(impl.release)
+
+	client, err := NewSlowPipeClient(impl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The directive bounds a call without a deadline.
+	if err := client.Wait(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait = %v, want context.DeadlineExceeded", err)
+	}
+
+	// An earlier deadline on the context is kept.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := client.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) >= 200*time.Millisecond {
+		t.Errorf("Wait = %v after %v, want context.DeadlineExceeded within the context deadline", err, time.Since(start))
+	}
+}
+`)
+
+	invalid := strings.Replace(src, "timeout=200ms", "timeout=soon", 1)
+	if err := os.WriteFile("service.go", []byte(invalid), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generate(Config{}); err == nil || !strings.Contains(err.Error(), `Slow.Wait has an invalid //rpc-gen:timeout directive "soon"`) {
+		t.Errorf("generation returned %v, want an invalid directive error", err)
+	}
+}
+
+func TestClientWith(t *testing.T) {
+	roundTrip(t, Config{}, arithService, `package m
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func TestClientWith(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+
+	rpcClient := rpc.NewClient(clientConn)
+	client := NewArithClientWith(rpcClient)
+
+	if reply, err := client.Add(context.Background(), Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+
+	// Closing the client closes the wrapped one.
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var reply Reply
+	if err := rpcClient.Call("Arith.Add", Args{}, &reply); !errors.Is(err, rpc.ErrShutdown) {
+		t.Errorf("Call on the wrapped client = %v, want rpc.ErrShutdown", err)
+	}
+}
+`)
+}
+
+func TestGenerateUndefinedType(t *testing.T) {
+	decls := "package m\n\ntype Args struct{ A, B int }\n\ntype Reply struct{ Sum int }\n"
+	src := strings.Replace(service, "type Args struct{ A, B int }\n\ntype Reply struct{ Sum int }\n", "", 1)
+
+	// Types declared in a sibling file resolve.
+	dir := writeModule(t, map[string]string{"types.go": decls, "arith.go": src})
+	if err := generate(Config{Options: Options{Assert: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+
+	typo := strings.Replace(src, "args Args", "args Argz", 1)
+	if err := os.WriteFile(filepath.Join(dir, "arith.go"), []byte(typo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := generate(Config{})
+	if want := "arith.go:8: Arith.Add references undefined type Argz"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("generation returned %v, want an error containing %q", err, want)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	roundTrip(t, Config{}, arithService, `package m
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	var calls []string
+	trace := func(name string) ArithInterceptor {
+		return func(ctx context.Context, method string, req any, invoke func() error) error {
+			calls = append(calls, fmt.Sprintf("%s before %s %v", name, method, req))
+			err := invoke()
+			calls = append(calls, fmt.Sprintf("%s after %v", name, err))
+			return err
+		}
+	}
+
+	denied := errors.New("denied")
+	deny := func(ctx context.Context, method string, req any, invoke func() error) error {
+		if method == MethodArithFail {
+			return denied
+		}
+
+		return invoke()
+	}
+
+	client, err := NewArithPipeClient(arith{}, WithArithInterceptor(trace("outer")), WithArithInterceptor(trace("inner")), WithArithInterceptor(deny))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	if reply, err := client.Add(ctx, Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+
+	want := []string{"outer before Arith.Add {1 2}", "inner before Arith.Add {1 2}", "inner after <nil>", "outer after <nil>"}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+
+	// An interceptor may fail the call without invoking it.
+	calls = nil
+	if err := client.Fail(ctx); !errors.Is(err, denied) {
+		t.Errorf("Fail = %v, want the interceptor's error", err)
+	}
+
+	if len(calls) != 4 || calls[3] != "outer after denied" {
+		t.Errorf("calls = %q", calls)
+	}
+}
+`)
+}
+
+func TestGenerateSuffix(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	// The second run skips the generated files, so ArithClientInterface is not a service.
+	c := Config{Suffix: ".pb.gen.go", All: true, Options: Options{ClientIface: true}}
+	for range 2 {
+		if err := generate(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	if want := []string{"arith.go", "arith_client.pb.gen.go", "arith_server.pb.gen.go", "go.mod"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("files = %v, want %v", names, want)
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateSuffixExclusion(t *testing.T) {
+	legacy := generatedHeader + "\n\n" + strings.NewReplacer("Arith", "Legacy", "type Args struct{ A, B int }\n\ntype Reply struct{ Sum int }\n", "").Replace(service)
+	dir := writeModule(t, map[string]string{"arith.go": service, "legacy.rpc.go": legacy})
+
+	// Only files ending in the configured suffix are skipped as generated.
+	for suffix, excluded := range map[string]bool{"_gen.go": false, ".rpc.go": true} {
+		services, err := parse(Config{Suffix: suffix})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, serviceData := range services {
+			names = append(names, serviceData.ServiceName)
+		}
+
+		if got := !slices.Contains(names, "Legacy"); got != excluded {
+			t.Errorf("with suffix %s the services are %v", suffix, names)
+		}
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateFuncResponse(t *testing.T) {
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Reset(ctx context.Context) error\n\tWatch(ctx context.Context, args Args) (context.CancelFunc, error)", 1)
+
+	got := strictDiagnostics(t, src)
+	if want := "Watch response type must be encodable, not a func or chan"; len(got) != 1 || got[0] != want {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+
+	services, err := parse(Config{Options: Options{Assert: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var methods []string
+	for _, method := range services[0].Methods {
+		methods = append(methods, method.Name)
+	}
+
+	if strings.Join(methods, " ") != "Add Reset" || services[0].Assert {
+		t.Errorf("methods = %v and Assert = %t, want Add and Reset without Assert", methods, services[0].Assert)
+	}
+}
+
+func TestRedial(t *testing.T) {
+	roundTrip(t, Config{Options: Options{Redial: true}}, arithService, `package m
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// offset adds n to every sum, telling its server apart.
+type offset struct {
+	arith
+	n int
+}
+
+func (o offset) Add(ctx context.Context, args Args) (*Reply, error) {
+	return &Reply{Sum: args.A + args.B + o.n}, nil
+}
+
+// serve serves impl on a new listener and returns its address.
+func serve(t *testing.T, impl Arith) string {
+	t.Helper()
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", NewArithServer(impl)); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go server.Accept(l)
+
+	return l.Addr().String()
+}
+
+func TestRedial(t *testing.T) {
+	first, second := serve(t, offset{n: 0}), serve(t, offset{n: 10})
+
+	client, err := NewArithClient(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	if reply, err := client.Add(ctx, Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add on the first server = %v, %v", reply, err)
+	}
+
+	if err := client.Redial(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply, err := client.Add(ctx, Args{A: 1, B: 2}); err != nil || reply.Sum != 13 {
+		t.Errorf("Add on the second server = %v, %v", reply, err)
+	}
+
+	// A failed redial keeps the current connection.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	if err := client.Redial(l.Addr().String()); err == nil {
+		t.Error("Redial to a closed port succeeded")
+	}
+
+	if reply, err := client.Add(ctx, Args{A: 1, B: 2}); err != nil || reply.Sum != 13 {
+		t.Errorf("Add after a failed redial = %v, %v", reply, err)
+	}
+
+	client.Close()
+	if err := client.Redial(first); err != rpc.ErrShutdown {
+		t.Errorf("Redial on a closed client = %v, want rpc.ErrShutdown", err)
+	}
+}
+`)
+}
+
+func TestGenerateAliasResponse(t *testing.T) {
+	files := map[string]string{"model/model.go": model, "store.go": `package m
+
+import (
+	"context"
+
+	"example.com/m/model"
+)
+
+type getResp = model.Resp
+
+type Value = Local
+
+type Local struct{ V int }
+
+//rpc-gen:service
+type Store interface {
+	Get(ctx context.Context, req model.Req) (*getResp, error)
+	Value(ctx context.Context, req model.Req) (Value, error)
+}
+`}
+
+	for name, c := range map[string]Config{"source": {}, "foreign": {Output: "clients", Package: "clients"}} {
+		t.Run(name, func(t *testing.T) {
+			client := generateVetted(t, files, c, filepath.Join(c.Output, "store_client_gen.go"))
+
+			local := "Local"
+			if c.Package != "" {
+				local = "m.Local"
+			}
+
+			for _, want := range []string{
+				"Get(ctx context.Context, req model.Req) (*model.Resp, error)",
+				"Value(ctx context.Context, req model.Req) (" + local + ", error)",
+				"gob.Register(model.Resp{})",
+				"gob.Register(" + local + "{})",
+			} {
+				if !strings.Contains(client, want) {
+					t.Errorf("client is missing %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateRaw(t *testing.T) {
+	const broken = generatedHeader + "\n\npackage {{.PackageName}}\n\nfunc {{.ServiceName}}( {\n"
+
+	dir := writeModule(t, map[string]string{"arith.go": service, "broken.tmpl": broken})
+	path := filepath.Join(dir, "arith_client_gen.go")
+
+	if err := generate(Config{Template: "broken.tmpl"}); err == nil {
+		t.Fatal("formatting code that does not parse succeeded")
+	}
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("code that does not parse was written: %v", err)
+	}
+
+	var log strings.Builder
+	if err := Generate(Config{Template: "broken.tmpl", Raw: true, Logger: slog.New(slog.NewTextHandler(&log, nil))}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readFile(t, path), generatedHeader+"\n\npackage m\n\nfunc Arith( {\n"; got != want {
+		t.Errorf("raw output = %q, want %q", got, want)
+	}
+
+	if !strings.Contains(log.String(), `level=WARN msg="Writing unformatted code" service=Arith`) {
+		t.Errorf("log does not warn about the unformatted file:\n%s", log.String())
+	}
+}
+
+func TestUnnamedParams(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type Args struct{ A, B int }
+
+type Reply struct{ Sum int }
+
+//rpc-gen:service
+type Arith interface {
+	Add(context.Context, Args) (*Reply, error)
+	Mul(context.Context, int, int) (int, error)
+	Named(ctx context.Context, values Args) (*Reply, error)
+}
+
+type arith struct{}
+
+func (arith) Add(_ context.Context, args Args) (*Reply, error) {
+	return &Reply{Sum: args.A + args.B}, nil
+}
+
+func (arith) Mul(_ context.Context, a, b int) (int, error) {
+	return a * b, nil
+}
+
+func (arith) Named(ctx context.Context, values Args) (*Reply, error) {
+	return arith{}.Add(ctx, values)
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestArith(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	if reply, err := client.Add(ctx, Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+
+	if product, err := client.Mul(ctx, 2, 3); err != nil || product != 6 {
+		t.Errorf("Mul = %d, %v", product, err)
+	}
+}
+`)
+
+	client := readFile(t, "arith_client_gen.go")
+	for _, want := range []string{
+		"Add(ctx context.Context, request Args) (*Reply, error)",
+		"Mul(ctx context.Context, arg0 int, arg1 int) (int, error)",
+		"Named(ctx context.Context, values Args) (*Reply, error)",
+	} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestMergedService(t *testing.T) {
+	const src = `package m
+
+import (
+	"context"
+	"sync"
+)
+
+type Key struct{ Name string }
+
+type Entry struct {
+	Name  string
+	Value int
+}
+
+//rpc-gen:service=Account
+type AccountReads interface {
+	Get(ctx context.Context, key Key) (int, error)
+}
+
+//rpc-gen:service=Account
+type AccountWrites interface {
+	Set(ctx context.Context, entry Entry) error
+}
+
+type accounts struct {
+	mu     sync.Mutex
+	values map[string]int
+}
+
+func (a *accounts) Get(_ context.Context, key Key) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.values[key.Name], nil
+}
+
+func (a *accounts) Set(_ context.Context, entry Entry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.values[entry.Name] = entry.Value
+	return nil
+}
+`
+
+	roundTrip(t, Config{}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+// The merged client implements both interfaces.
+var (
+	_ AccountReads  = (*AccountClient)(nil)
+	_ AccountWrites = (*AccountClient)(nil)
+)
+
+func TestAccount(t *testing.T) {
+	client, err := NewAccountPipeClient(&accounts{values: make(map[string]int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	if err := client.Set(ctx, Entry{Name: "a", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := client.Get(ctx, Key{Name: "a"}); err != nil || value != 1 {
+		t.Errorf("Get = %d, %v", value, err)
+	}
+}
+`)
+
+	client := readFile(t, "account_client_gen.go")
+	for _, want := range []string{`"Account.Get"`, `"Account.Set"`} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+
+	for _, unwanted := range []string{"accountreads_client_gen.go", "accountwrites_client_gen.go"} {
+		if _, err := os.Stat(unwanted); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists: %v", unwanted, err)
+		}
+	}
+
+	// A method declared by both interfaces is ambiguous.
+	duplicate := strings.Replace(src, "Set(ctx context.Context, entry Entry) error", "Set(ctx context.Context, entry Entry) error\n\tGet(ctx context.Context, key Key) (int, error)", 1)
+	if err := os.WriteFile("service.go", []byte(duplicate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generate(Config{}); err == nil || !strings.Contains(err.Error(), "service.go:17") || !strings.Contains(err.Error(), "service.go:23") {
+		t.Errorf("generation returned %v, want an error with both declarations of Get", err)
+	}
+}
+
+func TestClientFromConn(t *testing.T) {
+	const test = `package m
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+)
+
+// codec is the codec the client was generated for.
+const codec = "CODEC"
+
+func TestClientFromConn(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	if codec == "json" {
+		go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+	} else {
+		go server.ServeConn(serverConn)
+	}
+
+	client := NewArithClientFromConn(clientConn)
+	defer client.Close()
+
+	if reply, err := client.Add(context.Background(), Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+}
+`
+
+	for _, codec := range []string{"gob", "json"} {
+		t.Run(codec, func(t *testing.T) {
+			roundTrip(t, Config{Options: Options{Codec: codec}}, arithService, strings.ReplaceAll(test, "CODEC", codec))
+		})
+	}
+}
+
+func TestGenerateTypeCheck(t *testing.T) {
+	// The service is fine, but an unrelated function does not type-check.
+	broken := service + "\nfunc broken() int { return \"one\" }\n"
+	dir := writeModule(t, map[string]string{"arith.go": broken})
+
+	if err := generate(Config{}); err != nil {
+		t.Fatalf("generation without TypeCheck returned %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "arith_client_gen.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	var typeCheckErr *TypeCheckError
+	if err := generate(Config{TypeCheck: true}); !errors.As(err, &typeCheckErr) {
+		t.Fatalf("generation with TypeCheck returned %v, want a *TypeCheckError", err)
+	}
+
+	if len(typeCheckErr.Errors) != 1 || !strings.Contains(typeCheckErr.Error(), "arith.go:15:28: cannot use") {
+		t.Errorf("errors = %v, want the one in broken", typeCheckErr.Errors)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "arith_client_gen.go")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a package that does not type-check was generated for: %v", err)
+	}
+}
+
+func TestSourceAlias(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"service.go": arithService + "\n// Impl is the exported implementation.\ntype Impl struct{ arith }\n",
+		"clients/clients_test.go": `package clients
+
+import (
+	"context"
+	"testing"
+
+	api "example.com/m"
+)
+
+func TestArith(t *testing.T) {
+	client, err := NewArithPipeClient(api.Impl{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if reply, err := client.Add(context.Background(), api.Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+}
+`,
+	})
+
+	if err := generate(Config{Output: "clients", Package: "clients", SrcAlias: "api", Options: Options{Assert: true, Pipe: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	goCommand(t, dir, "test", "./...")
+
+	client := readFile(t, filepath.Join(dir, "clients", "arith_client_gen.go"))
+	for _, want := range []string{
+		`api "example.com/m"`,
+		"Add(ctx context.Context, argsArg api.Args) (*api.Reply, error)",
+		"gob.Register(api.Args{})",
+		"var _ api.Arith = (*ArithClient)(nil)",
+	} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestMethodsAccessor(t *testing.T) {
+	src := strings.Replace(arithService, "//rpc-gen:service\n", "//rpc-gen:service\n//rpc-gen:name=math.Arith\n", 1)
+
+	roundTrip(t, Config{Options: Options{MethodsAccessor: true}}, src, `package m
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMethods(t *testing.T) {
+	client, err := NewArithPipeClient(arith{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if got, want := client.Methods(), []string{"math.Arith.Add", "math.Arith.Sum", "math.Arith.Fail"}; !slices.Equal(got, want) {
+		t.Errorf("Methods = %q, want %q", got, want)
+	}
+}
+`)
+}
+
+func TestContextDial(t *testing.T) {
+	roundTrip(t, Config{Options: Options{ContextDial: true}}, arithService, `package m
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestClientContext(t *testing.T) {
+	if err := RegisterArithServer(NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeArith(l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := NewArithClientContext(ctx, l.Addr().String()); !errors.Is(err, context.Canceled) {
+		t.Errorf("NewArithClientContext with a canceled context = %v, want context.Canceled", err)
+	}
+
+	client, err := NewArithClientContext(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if reply, err := client.Add(context.Background(), Args{A: 1, B: 2}); err != nil || reply.Sum != 3 {
+		t.Errorf("Add = %v, %v", reply, err)
+	}
+}
+`)
+}
+
+func TestGenerateInvalidServiceName(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	for directive, want := range map[string]string{
+		`//rpc-gen:prefix=""`:   "net/rpc requires Service.Method names, so //rpc-gen:prefix is not supported",
+		`//rpc-gen:name=`:       `Arith has an invalid //rpc-gen:name directive ""`,
+		`//rpc-gen:name=.Arith`: `Arith has an invalid //rpc-gen:name directive ".Arith"`,
+		`//rpc-gen:name=a b`:    `Arith has an invalid //rpc-gen:name directive "a b"`,
+	} {
+		src := strings.Replace(service, "//rpc-gen:service\n", "//rpc-gen:service\n"+directive+"\n", 1)
+		if err := os.WriteFile(filepath.Join(dir, "arith.go"), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := generate(Config{}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("with %s generation returned %v, want an error containing %q", directive, err, want)
+		}
+	}
+}
+
+func TestSliceResponse(t *testing.T) {
+	const src = `package m
+
+import (
+	"context"
+	"strings"
+)
+
+type Filter struct{ Prefix string }
+
+type Item struct{ Name string }
+
+//rpc-gen:service
+type Catalog interface {
+	List(ctx context.Context, filter Filter) (*[]Item, error)
+}
+
+type catalog []Item
+
+func (c catalog) List(_ context.Context, filter Filter) (*[]Item, error) {
+	var items []Item
+	for _, item := range c {
+		if strings.HasPrefix(item.Name, filter.Prefix) {
+			items = append(items, item)
+		}
+	}
+
+	return &items, nil
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	client, err := NewCatalogPipeClient(catalog{{Name: "apple"}, {Name: "avocado"}, {Name: "banana"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	items, err := client.List(context.Background(), Filter{Prefix: "a"})
+	if err != nil || len(*items) != 2 || (*items)[1].Name != "avocado" {
+		t.Errorf("List = %v, %v", items, err)
+	}
+}
+`)
+
+	client := readFile(t, "catalog_client_gen.go")
+	for _, want := range []string{"List(ctx context.Context, filter Filter) (*[]Item, error)", "gob.Register([]Item{})"} {
+		if !strings.Contains(client, want) {
+			t.Errorf("client is missing %q", want)
+		}
+	}
+}
+
+func TestGenerateMissingContextImport(t *testing.T) {
+	// The file declares a service using context.Context without importing context.
+	src := strings.Replace(service, "import \"context\"\n", "", 1)
+
+	got := strictDiagnostics(t, src)
+	want := []string{
+		`Add first parameter is context.Context but the file does not import "context"`,
+		`Reset first parameter is context.Context but the file does not import "context"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateServiceDoc(t *testing.T) {
+	src := strings.Replace(service, "//rpc-gen:service\n", "// Arith adds numbers.\n//\n// It keeps no state.\n//\n//rpc-gen:service\n", 1)
+	client := generateVetted(t, map[string]string{"arith.go": src}, Config{}, "arith_client_gen.go")
+
+	// The doc is carried over without the directive.
+	if want := "// Arith adds numbers.\n//\n// It keeps no state.\ntype ArithClient struct {"; !strings.Contains(client, want) {
+		t.Errorf("client is missing %q", want)
+	}
+
+	if strings.Contains(client, "//rpc-gen:service") {
+		t.Error("client carries the service directive")
+	}
+}
+
+func TestScalarRequest(t *testing.T) {
+	const src = `package m
+
+import (
+	"context"
+	"strconv"
+)
+
+type Item struct{ Name string }
+
+//rpc-gen:service
+type Items interface {
+	Get(ctx context.Context, id int) (*Item, error)
+	Count(ctx context.Context, name string) (int, error)
+}
+
+type items struct{}
+
+func (items) Get(_ context.Context, id int) (*Item, error) {
+	return &Item{Name: "item " + strconv.Itoa(id)}, nil
+}
+
+func (items) Count(_ context.Context, name string) (int, error) {
+	return len(name), nil
+}
+`
+
+	roundTrip(t, Config{Options: Options{Assert: true}}, src, `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestItems(t *testing.T) {
+	client, err := NewItemsPipeClient(items{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+
+	if item, err := client.Get(ctx, 7); err != nil || item.Name != "item 7" {
+		t.Errorf("Get = %v, %v", item, err)
+	}
+
+	if n, err := client.Count(ctx, "four"); err != nil || n != 4 {
+		t.Errorf("Count = %d, %v", n, err)
+	}
+}
+`)
+
+	client := readFile(t, "items_client_gen.go")
+	if strings.Count(client, "gob.Register(") != 1 || !strings.Contains(client, "gob.Register(Item{})") {
+		t.Error("client registers other types than Item")
+	}
+}
+
+func TestStringer(t *testing.T) {
+	roundTrip(t, Config{Options: Options{Stringer: true, Redial: true}}, arithService, `package m
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	if err := RegisterArithServer(NewArithServer(arith{})); err != nil {
+		t.Fatal(err)
+	}
+
+	var addresses []string
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		go ServeArith(l)
+		addresses = append(addresses, l.Addr().String())
+	}
+
+	client, err := NewArithClient(addresses[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if got, want := fmt.Sprint(client), "Arith client of "+addresses[0]; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+
+	// The address follows the connection.
+	if err := client.Redial(addresses[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := client.String(), "Arith client of "+addresses[1]; got != want {
+		t.Errorf("String after Redial = %q, want %q", got, want)
+	}
+
+	conn, _ := net.Pipe()
+	wrapped := NewArithClientWith(rpc.NewClient(conn))
+	defer wrapped.Close()
+
+	if got, want := wrapped.String(), "Arith client"; got != want {
+		t.Errorf("String without an address = %q, want %q", got, want)
+	}
+}
+`)
+}
+
+func TestGenerateOutputCreatesDirs(t *testing.T) {
+	dir := writeModule(t, map[string]string{"arith.go": service})
+
+	if err := generate(Config{Output: "gen/rpc/clients", Package: "clients"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"arith_client_gen.go", "arith_server_gen.go"} {
+		if _, err := os.Stat(filepath.Join(dir, "gen", "rpc", "clients", name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestGenerateFiles(t *testing.T) {
+	rename := func(name string) string {
+		return strings.NewReplacer("Arith", name, "type Args struct{ A, B int }\n\ntype Reply struct{ Sum int }\n", "").Replace(service)
+	}
+
+	dir := writeModule(t, map[string]string{
+		"types.go": "package m\n\ntype Args struct{ A, B int }\n\ntype Reply struct{ Sum int }\n",
+		"a.go":     rename("Alpha"),
+		"b.go":     rename("Beta"),
+		"c.go":     rename("Gamma"),
+		"sub/d.go": strings.Replace(service, "package m", "package sub", 1),
+	})
+
+	if err := generate(Config{Files: []string{"a.go", "b.go", "sub/d.go"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]bool{
+		"alpha_client_gen.go":     true,
+		"sub/arith_client_gen.go": true,
+		"beta_client_gen.go":      true,
+		"gamma_client_gen.go":     false,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, path)); (err == nil) != want {
+			t.Errorf("%s exists: %t, want %t", path, err == nil, want)
+		}
+	}
+
+	goCommand(t, dir, "vet", "./...")
+}
+
+func TestMetadata(t *testing.T) {
+	const src = `package m
+
+import "context"
+
+type Greeting struct{ Name string }
+
+//rpc-gen:service
+type Greeter interface {
+	Greet(ctx context.Context, greeting Greeting) (string, error)
+	Whoami(ctx context.Context) (string, error)
+}
+
+type greeter struct{}
+
+func (greeter) Greet(ctx context.Context, greeting Greeting) (string, error) {
+	return GreeterMetadataFrom(ctx)["greeting"] + ", " + greeting.Name, nil
+}
+
+func (greeter) Whoami(ctx context.Context) (string, error) {
+	return GreeterMetadataFrom(ctx)["user"], nil
+}
+`
+
+	const test = `package m
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	client, err := NewGreeterPipeClient(greeter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := WithGreeterMetadata(context.Background(), map[string]string{"user": "ada", "greeting": "Hello"})
+
+	if user, err := client.Whoami(ctx); err != nil || user != "ada" {
+		t.Errorf("Whoami = %q, %v", user, err)
+	}
+
+	if greeting, err := client.Greet(ctx, Greeting{Name: "Bob"}); err != nil || greeting != "Hello, Bob" {
+		t.Errorf("Greet = %q, %v", greeting, err)
+	}
+
+	// A context without metadata sends none.
+	if user, err := client.Whoami(context.Background()); err != nil || user != "" {
+		t.Errorf("Whoami without metadata = %q, %v", user, err)
+	}
+}
+`
+
+	for _, codec := range []string{"gob", "json"} {
+		t.Run(codec, func(t *testing.T) {
+			roundTrip(t, Config{Options: Options{Metadata: true, Codec: codec, Assert: true}}, src, test)
+		})
+	}
+}
+
+func TestGenerateUnexportedMethod(t *testing.T) {
+	src := strings.Replace(service, "Reset(ctx context.Context) error", "Reset(ctx context.Context) error\n\tfoo(ctx context.Context, args Args) (*Reply, error)", 1)
+
+	got := strictDiagnostics(t, src)
+	if want := "foo is unexported; net/rpc only serves exported methods"; len(got) != 1 || got[0] != want {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+
+	if err := generate(Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if client := readFile(t, "arith_client_gen.go"); strings.Contains(client, "foo") {
+		t.Error("client calls the unexported method")
+	}
+}
@@ -1,351 +1,214 @@
 package main
 
 import (
-	"bytes"
-	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"go/ast"
-	"go/token"
+	"io"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"regexp"
 	"strings"
-	"text/template"
 
-	"golang.org/x/tools/go/packages"
-	"golang.org/x/tools/imports"
+	"github.com/samix73/rpc-gen/generator"
 )
 
-const clientTemplate = `
-// Code generated by rpc client generator. DO NOT EDIT.
-
-package {{.PackageName}}
-
-var _ {{.ServiceName}} = (*{{.ServiceName}}Client)(nil)
-
-type {{.ServiceName}}Client struct {
-   client *rpc.Client
-}
-
-func New{{.ServiceName}}Client(address string) (*{{.ServiceName}}Client, error) {
-   client, err := rpc.Dial("tcp", address)
-   if err != nil {
-       return nil, fmt.Errorf("{{$.PackageName}}.New{{.ServiceName}}Client rpc.Dial error: %w", err)
-   }
-
-   return &{{.ServiceName}}Client{client: client}, nil
-}
-
-{{range .Methods}}
-func (c *{{$.ServiceName}}Client) {{.Name}}(request *{{.RequestType}}, response *{{.ResponseType}}) error {
-   err := c.client.Call("{{$.ServiceName}}.{{.Name}}", request, response)
-   if err != nil {
-       return fmt.Errorf("{{$.PackageName}}.{{$.ServiceName}}Client.{{.Name}} Call error: %w", err)
-   }
-
-   return nil
-}
-{{end}}
-
-func (c *{{.ServiceName}}Client) Close() error {
-   return c.client.Close()
-}
-`
-
-type Method struct {
-	Name         string
-	RequestType  string
-	ResponseType string
-}
-
-type ServiceData struct {
-	PackageName string
-	ServiceName string
-	FilePath    string
-	Methods     []Method
-}
-
 var (
-	input   = flag.String("input", "./...", "Input Go package directory (required)")
-	verbose = flag.Bool("verbose", false, "Enable verbose logging")
+	input             = flag.String("input", "./...", "Input Go package directory (required)")
+	files             = flag.String("files", "", "Comma-separated Go files to generate for instead of every file of -input, e.g. a.go,b.go")
+	tags              = flag.String("tags", "", "Comma-separated build tags to satisfy when choosing the files to load, as with go build -tags")
+	verbose           = flag.Bool("verbose", false, "Enable verbose logging; shortcut for -log-level=debug")
+	logFormat         = flag.String("log-format", "text", "Log output format: text or json")
+	logLevel          = flag.String("log-level", "error", "Minimum log level: debug, info, warn or error")
+	typeCheck         = flag.Bool("typecheck", false, "Fail before writing anything when the input packages do not type-check")
+	methodFilter      = flag.String("method-filter", "", "Only generate the methods whose name matches this regular expression, e.g. ^Get|^List")
+	looseCtx          = flag.Bool("loose-ctx", false, "Accept any qualified type, or pointer to one, as the first method parameter, not only context.Context")
+	strict            = flag.Bool("strict", false, "Fail when an interface method has an unsupported signature instead of skipping it")
+	all               = flag.Bool("all", false, "Generate for every interface, not only those marked with //rpc-gen:service")
+	packageFlag       = flag.String("package", "", "Package name of the generated files (defaults to the source package)")
+	stripSuffix       = flag.String("strip-suffix", "", "Suffix trimmed from interface names to name the generated code, e.g. Service to turn AccountService into AccountClient")
+	stripRPCSuffix    = flag.Bool("strip-rpc-suffix", false, "Also trim -strip-suffix from the RPC service name; by default calls keep the interface name")
+	srcAlias          = flag.String("src-alias", "", "Name the source package is imported under by code generated outside it (defaults to its package name)")
+	recursive         = flag.Bool("recursive", false, "Also process the packages in subdirectories of -input")
+	output            = flag.String("output", "", "Output directory for generated files (defaults to the directory of each interface)")
+	assert            = flag.Bool("assert", true, "Emit a compile-time assertion that the client implements the interface")
+	network           = flag.String("network", "tcp", "Network the generated client dials: tcp, unix or http (rpc.DialHTTP over tcp)")
+	httpPath          = flag.String("http-path", "", "RPC path dialed with -network=http (defaults to rpc.DefaultRPCPath)")
+	codec             = flag.String("codec", "gob", "Codec the generated client speaks: gob or json (JSON-RPC 1.0)")
+	async             = flag.Bool("async", false, "Also emit a <Method>Async variant of each method returning the pending *rpc.Call")
+	methodsAccessor   = flag.Bool("methods-accessor", false, "Also emit a Methods method returning the RPC method names the client calls")
+	pipe              = flag.Bool("pipe", false, "Also emit a New<Service>PipeClient serving an implementation in memory over net.Pipe, for tests")
+	withMetadata      = flag.Bool("with-metadata", false, "Send metadata from the call's context with every request, wrapped in a <Service>Envelope")
+	typedErrors       = flag.Bool("typed-errors", false, "Return failed calls as an *RPCError naming the method, for errors.As")
+	stringer          = flag.Bool("stringer", false, "Also emit a String method identifying the client by its service and remote address")
+	exposeConn        = flag.Bool("expose-conn", false, "Also emit a Conn method returning the client's underlying *rpc.Client")
+	ctxDial           = flag.Bool("ctx-dial", false, "Also emit a New<Service>ClientContext constructor whose dial is cancelled with a context")
+	tlsFlag           = flag.Bool("tls", false, "Also emit a New<Service>ClientTLS constructor, a shorthand for the With<Service>TLSConfig option")
+	dialTimeout       = flag.Duration("dial-timeout", 0, "Default dial timeout of the generated clients, overridden with With<Service>Timeout (0 means none)")
+	clientIface       = flag.Bool("client-iface", false, "Emit an interface implemented by the generated client for mocking")
+	clientIfaceSuffix = flag.String("client-iface-suffix", "ClientInterface", "Suffix appended to the service name to name the -client-iface interface")
+	templatePath      = flag.String("template", "", "Path to a custom client template (defaults to the built-in one)")
+	retries           = flag.Int("retries", 0, "Retry calls failing with a connection error up to this many times with exponential backoff, redialing first; implies -reconnect")
+	pool              = flag.Int("pool", 0, "Also emit a <Service>Pool spreading calls round-robin over this many connections (0 means none)")
+	redial            = flag.Bool("redial", false, "Also emit a Redial method connecting the generated client to another address")
+	reconnect         = flag.Bool("reconnect", false, "Make the generated client redial when its connection fails; retries once unless -retries is set")
+	noRegister        = flag.Bool("no-register", false, "Omit the init function registering request and response types with gob")
+	clean             = flag.Bool("clean", false, "Delete files ending in -suffix and carrying the rpc-gen header from the input and output directories before generating")
+	dryRun            = flag.Bool("dry-run", false, "Print the detected services and methods without writing any files")
+	singleFile        = flag.Bool("single-file", false, "Write the clients, servers and request types of all services in a directory to one file each")
+	verify            = flag.Bool("verify", false, "Check that the generated files on disk are up to date without writing anything; exit 1 if not")
+	manifest          = flag.String("manifest", "", "Write the detected services and methods as JSON to this path")
+	raw               = flag.Bool("raw", false, "Write the template output without formatting it, to debug templates producing invalid code")
+	force             = flag.Bool("force", false, "Overwrite existing files that were not generated by rpc-gen")
+	stdout            = flag.Bool("stdout", false, "Write generated code to standard output instead of files")
+	headerPath        = flag.String("header", "", "File whose contents, such as a license comment, are prepended to every generated file")
+	suffix            = flag.String("suffix", "_gen.go", "Suffix of generated file names, also used to find the files -clean deletes")
+	fileNamePattern   = flag.String("filename", generator.DefaultFileName, "Template for generated file names; has .ServiceName, .PackageName, .Kind (client, server or types) and .Suffix")
 )
 
-func log(level slog.Level, format string, args ...any) {
-	if *verbose {
-		slog.Log(context.Background(), level, format, args...)
-	}
-}
-
-func extractTypeName(expr ast.Expr) string {
-	switch t := expr.(type) {
-	case *ast.Ident:
-		return t.Name
-	case *ast.StarExpr:
-		return "*" + extractTypeName(t.X)
-	default:
-		return "unknown"
-	}
-}
-
-func validateMethodSignature(fset *token.FileSet, fileName, serviceName, methodName string, funcType *ast.FuncType) bool {
-	if funcType == nil {
-		pos := fset.Position(funcType.Pos())
-		log(slog.LevelError, "is not a valid function",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-
-		return false
+// setupLogger replaces the default logger with one writing -log-format records
+// at -log-level or above to w.
+func setupLogger(w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q: use debug, info, warn or error", *logLevel)
 	}
 
-	if funcType.Params == nil {
-		pos := fset.Position(funcType.Pos())
-		log(slog.LevelError, "has no parameters",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-
-		return false
-	}
-
-	if len(funcType.Params.List) != 2 {
-		pos := fset.Position(funcType.Pos())
-		log(slog.LevelError, "does not have exactly two parameters",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-		return false
-	}
-
-	if _, ok := funcType.Params.List[0].Type.(*ast.StarExpr); !ok {
-		pos := fset.Position(funcType.Params.List[0].Pos())
-		log(slog.LevelError, "first parameter must be a pointer",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-		return false
-	}
-
-	if _, ok := funcType.Params.List[1].Type.(*ast.StarExpr); !ok {
-		pos := fset.Position(funcType.Params.List[1].Pos())
-		log(slog.LevelError, "second parameter must be a pointer",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-		return false
-	}
-
-	if funcType.Results == nil {
-		pos := fset.Position(funcType.Pos())
-		log(slog.LevelError, "has no return values",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-
-		return false
-	}
-
-	if len(funcType.Results.List) != 1 {
-		pos := fset.Position(funcType.Pos())
-
-		log(slog.LevelError, "method does not have exactly two return values",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-		return false
-	}
-
-	errRespIdent, ok := funcType.Results.List[0].Type.(*ast.Ident)
-	if !ok {
-		pos := fset.Position(funcType.Results.List[0].Pos())
-		log(slog.LevelError, "first return value is not valid",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
-
-		return false
+	if *verbose {
+		level = slog.LevelDebug
 	}
 
-	if errRespIdent.Name != "error" {
-		pos := fset.Position(funcType.Results.List[1].Pos())
-		log(slog.LevelError, "second return value is not error",
-			slog.String("info", fmt.Sprintf("%s:%d:%d %s.%s",
-				fileName, pos.Line, pos.Column, serviceName, methodName),
-			))
+	handlerOptions := &slog.HandlerOptions{Level: level}
 
-		return false
+	var handler slog.Handler
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(w, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	default:
+		return fmt.Errorf("invalid log format %q: use text or json", *logFormat)
 	}
 
-	return true
-}
-
-func extractMethods(fset *token.FileSet, fileName, serviceName string, interfaceType *ast.InterfaceType) []Method {
-	var methods []Method
-
-	for _, method := range interfaceType.Methods.List {
-		if funcType, ok := method.Type.(*ast.FuncType); ok {
-			if !validateMethodSignature(fset, fileName, serviceName, method.Names[0].Name, funcType) {
-				continue
-			}
-
-			methodName := method.Names[0].Name
-
-			requestType := extractTypeName(funcType.Params.List[0].Type)
-			responseType := extractTypeName(funcType.Params.List[1].Type)
-
-			// Remove pointer prefix from response type
-			requestType = strings.TrimPrefix(requestType, "*")
-			responseType = strings.TrimPrefix(responseType, "*")
-
-			methods = append(methods, Method{
-				Name:         methodName,
-				RequestType:  requestType,
-				ResponseType: responseType,
-			})
-		}
-	}
+	slog.SetDefault(slog.New(handler))
 
-	return methods
+	return nil
 }
 
-func generateClientCode(temp *template.Template, serviceData ServiceData) error {
-	buf := new(bytes.Buffer)
-	if err := temp.Execute(buf, serviceData); err != nil {
-		return fmt.Errorf("error executing template: %w", err)
-	}
-
-	formatted, err := imports.Process("", buf.Bytes(), nil)
-	if err != nil {
-		return fmt.Errorf("imports error: %w", err)
-	}
-
-	basePath := filepath.Dir(serviceData.FilePath)
+func main() {
+	flag.Parse()
 
-	fileName := fmt.Sprintf("%s_client_gen.go", strings.ToLower(serviceData.ServiceName))
-	file, err := os.Create(filepath.Join(basePath, fileName))
-	if err != nil {
-		return fmt.Errorf("error creating file %s: %w", fileName, err)
+	if err := setupLogger(os.Stderr); err != nil {
+		slog.Error("Error configuring logging", slog.String("error", err.Error()))
+		os.Exit(1)
 	}
-	defer func() { _ = file.Close() }()
 
-	if _, err := file.Write(formatted); err != nil {
-		return fmt.Errorf("error writing to file %s: %w", fileName, err)
+	if *input == "" {
+		slog.Error("Input package directory is required. Use -input flag to specify it.")
+		os.Exit(1)
 	}
 
-	return nil
-}
-
-func deleteGeneratedFiles(dir string) error {
-	if err := filepath.Walk(filepath.Dir(dir), func(path string, info os.FileInfo, err error) error {
+	var header string
+	if *headerPath != "" {
+		data, err := os.ReadFile(*headerPath)
 		if err != nil {
-			return fmt.Errorf("error accessing path %s: %w", path, err)
+			slog.Error("Error reading header file", slog.String("error", err.Error()))
+			os.Exit(1)
 		}
 
-		if info.IsDir() {
-			return nil
-		}
+		header = string(data)
+	}
 
-		if !strings.Contains(info.Name(), "_gen.go") {
-			return nil
+	var fileList []string
+	for _, file := range strings.Split(*files, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			fileList = append(fileList, file)
 		}
+	}
 
-		if err := os.Remove(path); err != nil {
-			return fmt.Errorf("error deleting file %s: %w", path, err)
+	var filter *regexp.Regexp
+	if *methodFilter != "" {
+		var err error
+		if filter, err = regexp.Compile(*methodFilter); err != nil {
+			slog.Error("Invalid method filter", slog.String("error", err.Error()))
+			os.Exit(1)
 		}
-
-		return nil
-	}); err != nil {
-		return fmt.Errorf("error walking directory %s: %w", dir, err)
 	}
 
-	return nil
-}
-
-func main() {
-	flag.Parse()
-
-	if *input == "" {
-		slog.Error("Input package directory is required. Use -input flag to specify it.")
+	err := generator.Generate(generator.Config{
+		Options: generator.Options{
+			Assert:      *assert,
+			Network:     *network,
+			HTTPPath:    *httpPath,
+			Codec:       *codec,
+			TLS:         *tlsFlag,
+			Async:       *async,
+			DialTimeout: *dialTimeout,
+			NoRegister:  *noRegister,
+			Retries:     *retries,
+			Reconnect:   *reconnect,
+			Redial:      *redial,
+			ExposeConn:  *exposeConn,
+			Header:      header,
+
+			ContextDial:       *ctxDial,
+			MethodsAccessor:   *methodsAccessor,
+			Pipe:              *pipe,
+			Pool:              *pool,
+			Stringer:          *stringer,
+			TypedErrors:       *typedErrors,
+			Metadata:          *withMetadata,
+			ClientIface:       *clientIface,
+			ClientIfaceSuffix: *clientIfaceSuffix,
+		},
+		Input:          *input,
+		Recursive:      *recursive,
+		Files:          fileList,
+		Tags:           *tags,
+		Package:        *packageFlag,
+		SrcAlias:       *srcAlias,
+		StripSuffix:    *stripSuffix,
+		StripRPCSuffix: *stripRPCSuffix,
+		Output:         *output,
+		All:            *all,
+		MethodFilter:   filter,
+		Strict:         *strict,
+		LooseContext:   *looseCtx,
+		TypeCheck:      *typeCheck,
+		Clean:          *clean,
+		DryRun:         *dryRun,
+		SingleFile:     *singleFile,
+		Verify:         *verify,
+		Manifest:       *manifest,
+		Stdout:         *stdout,
+		Raw:            *raw,
+		Force:          *force,
+		Suffix:         *suffix,
+		FileName:       *fileNamePattern,
+		Template:       *templatePath,
+	})
+
+	var invalid *generator.InvalidMethodsError
+	if errors.As(err, &invalid) {
+		fmt.Fprintln(os.Stderr, invalid)
 		os.Exit(1)
 	}
 
-	if err := deleteGeneratedFiles(*input); err != nil {
-		slog.Error("Error deleting generated files", slog.String("error", err.Error()))
+	var typeErr *generator.TypeCheckError
+	if errors.As(err, &typeErr) {
+		fmt.Fprintln(os.Stderr, typeErr)
+		fmt.Fprintln(os.Stderr, "input packages do not type-check; nothing was generated")
 		os.Exit(1)
 	}
 
-	cfg := &packages.Config{
-		Mode: packages.NeedName |
-			packages.NeedFiles |
-			packages.NeedTypes |
-			packages.NeedTypesInfo |
-			packages.NeedSyntax |
-			packages.NeedImports |
-			packages.NeedDeps,
-	}
-	pkgs, err := packages.Load(cfg, *input)
-	if err != nil {
-		slog.Error(err.Error())
+	if errors.Is(err, generator.ErrStale) {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "generated code is out of date; run rpc-gen to update it")
 		os.Exit(1)
 	}
 
-	var serviceDatas []ServiceData
-
-	for _, pkg := range pkgs {
-		if len(pkg.Errors) > 0 {
-			for _, pkgErr := range pkg.Errors {
-				log(slog.LevelError, "Package load error", slog.String("error", pkgErr.Error()))
-			}
-
-			continue
-		}
-
-		log(slog.LevelInfo, "Processing package", slog.String("package", pkg.PkgPath))
-
-		for _, file := range pkg.Syntax {
-			fileName := pkg.Fset.Position(file.Pos()).Filename
-
-			log(slog.LevelInfo, "Processing file", slog.String("file", fileName))
-
-			ast.Inspect(file, func(n ast.Node) bool {
-				if typeSpec, ok := n.(*ast.TypeSpec); ok {
-					if interfaceType, ok := typeSpec.Type.(*ast.InterfaceType); ok {
-						serviceName := typeSpec.Name.Name
-						log(slog.LevelInfo, "Found interface", slog.String("name", serviceName))
-
-						// Extract methods from interface
-						methods := extractMethods(pkg.Fset, fileName, serviceName, interfaceType)
-
-						serviceDatas = append(serviceDatas, ServiceData{
-							FilePath:    fileName,
-							PackageName: pkg.Name,
-							ServiceName: serviceName,
-							Methods:     methods,
-						})
-					}
-				}
-
-				return true
-			})
-		}
-	}
-
-	temp := template.New("clientTemplate")
-	temp, err = temp.Parse(clientTemplate)
 	if err != nil {
-		slog.Error("Error parsing template", slog.String("error", err.Error()))
+		slog.Error("Error generating code", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
-
-	for _, serviceData := range serviceDatas {
-		log(slog.LevelInfo, "Generating client for service", slog.String("service", serviceData.ServiceName))
-
-		if err := generateClientCode(temp, serviceData); err != nil {
-			slog.Error("Error generating client code", slog.String("error", err.Error()))
-			os.Exit(1)
-		}
-
-		log(slog.LevelInfo, "Client code generated successfully for service", slog.String("service", serviceData.ServiceName))
-	}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetupLoggerJSON(t *testing.T) {
+	defaultLogger := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		*logFormat, *logLevel, *verbose = "text", "error", false
+	})
+
+	*logFormat, *logLevel = "json", "info"
+
+	var out strings.Builder
+	if err := setupLogger(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	slog.Debug("Hidden")
+	slog.Info("Generated client", slog.String("service", "Arith"))
+
+	var record struct {
+		Level   string `json:"level"`
+		Msg     string `json:"msg"`
+		Service string `json:"service"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &record); err != nil {
+		t.Fatalf("log is not one JSON record: %v\n%s", err, out.String())
+	}
+
+	if record.Level != "INFO" || record.Msg != "Generated client" || record.Service != "Arith" {
+		t.Errorf("record = %+v", record)
+	}
+
+	// -verbose is a shortcut for the debug level.
+	*verbose = true
+	out.Reset()
+	if err := setupLogger(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	slog.Debug("Shown")
+	if !strings.Contains(out.String(), `"msg":"Shown"`) {
+		t.Errorf("verbose log = %q, want the debug record", out.String())
+	}
+}
+
+func TestSetupLoggerInvalid(t *testing.T) {
+	t.Cleanup(func() { *logFormat, *logLevel = "text", "error" })
+
+	*logFormat = "xml"
+	if err := setupLogger(&strings.Builder{}); err == nil {
+		t.Error("setupLogger accepted the xml format")
+	}
+
+	*logFormat, *logLevel = "json", "loud"
+	if err := setupLogger(&strings.Builder{}); err == nil {
+		t.Error("setupLogger accepted the loud level")
+	}
+}